@@ -33,6 +33,7 @@ func BuildCommand(version, buildHash, buildDate string) *cobra.Command {
 	cmd.AddCommand(o.gear())
 	cmd.AddCommand(o.job())
 	cmd.AddCommand(o.bidsCommand())
+	cmd.AddCommand(o.dicomCommand())
 
 	AddDelegateCommand(cmd, "import", "Import data into Flywheel")
 	AddDelegateCommand(cmd, "export", "Export data from Flywheel")
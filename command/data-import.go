@@ -22,6 +22,16 @@ func (o *opts) importCommand() *cobra.Command {
 }
 
 func (o *opts) importFolder() *cobra.Command {
+	var template string
+	var group string
+	var project string
+	var subject string
+	var session string
+	var reportPath string
+	var pack string
+	var packfileTypes []string
+	var yes bool
+
 	cmd := &cobra.Command{
 		Use:   "folder [folder]",
 		Short: "Import a structured folder",
@@ -39,39 +49,127 @@ root-folder
                     ├── data.foo
                     └── scan.nii.gz
 
-Files can be placed at the project level and below. Files to be uploaded via a packfile upload must be placed in a folder under the acquisition folder, the folder name will be used as the file type.`,
+Files can be placed at the project level and below. Files to be uploaded via a packfile upload must be placed in a folder under the acquisition folder, the folder name will be used as the file type unless --packfile-type is given. Nested folders are included with their relative paths. With --pack zip, each such folder is zipped locally and uploaded as a single file instead.
+
+A failed request asks whether to retry it. With --yes, or when input is not a terminal, it is retried up to 3 times
+with backoff and then skipped; --yes also skips confirming the upload.
+
+Other layouts can be described with --template. Each path segment of the template matches one folder level;
+{group}, {project}, {subject}, {session} and {acquisition} capture labels, {level:regex} captures with a custom
+pattern, and * matches anything. Levels the layout does not contain can be fixed with the matching flag:
+
+  fw import folder --template '{subject}_{session}/{acquisition}/*' --group psychology --project Anxiety exports/`,
 		Args:   cobra.ExactArgs(1),
 		PreRun: o.RequireClient,
 		Run: func(cmd *cobra.Command, args []string) {
-			ops.ScanUpload(o.Client, args[0])
+			overrides := map[string]string{
+				"group":   group,
+				"project": project,
+				"subject": subject,
+				"session": session,
+			}
+
+			options := &ops.ScanOptions{
+				Template:      template,
+				Overrides:     overrides,
+				ReportPath:    reportPath,
+				Pack:          pack,
+				PackfileTypes: packfileTypes,
+				Yes:           yes,
+			}
+
+			ops.ScanUpload(o.Client, args[0], options)
 		},
 	}
 
+	cmd.Flags().StringVarP(&template, "template", "t", ops.DefaultScanTemplate, "Folder layout to map onto the hierarchy")
+	cmd.Flags().StringVarP(&group, "group", "g", "", "Import into this group id instead of a template level")
+	cmd.Flags().StringVarP(&project, "project", "p", "", "Import into this project label instead of a template level")
+	cmd.Flags().StringVar(&subject, "subject", "", "Import into this subject code instead of a template level")
+	cmd.Flags().StringVar(&session, "session", "", "Import into this session label instead of a template level")
+	cmd.Flags().StringVar(&reportPath, "report", "", "Write a JSON report of the import to this file")
+	cmd.Flags().StringVar(&pack, "pack", ops.PackPackfile, "Upload acquisition subfolders as a server-side packfile or a local zip (packfile, zip)")
+	cmd.Flags().StringSliceVar(&packfileTypes, "packfile-type", []string{}, "File type for packed folders, as TYPE or FOLDER=TYPE")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Upload without confirming, and retry failed requests instead of asking")
+
 	return cmd
 }
 
 func (o *opts) importDicom() *cobra.Command {
-	var quiet bool
-	var noTree bool
-	var local bool
+	options := &dicom.ScanOptions{}
 
 	cmd := &cobra.Command{
-		Use:    "dicom [folder] [group-id] [project-label]",
-		Short:  "Import a folder of dicom files",
+		Use:   "dicom [folder|archive] [group-id] [project-label]",
+		Short: "Import a folder of dicom files",
+		Long: `Import a folder of dicom files, sorted into sessions by StudyInstanceUID and acquisitions by SeriesInstanceUID.
+
+A .zip, .tar or .tar.gz archive can be given in place of the folder; it is read in place, without extracting it.
+Folders and archives with a DICOMDIR only import the files it references.
+
+Labels can be built from any DICOM tag with --session-label, --acquisition-label and --subject. Placeholders name
+a tag by keyword or hex, and take optional functions: date[:layout], time[:layout], upper, lower and default:text.
+Layouts are written as the reference date and time 2006-01-02 15:04:05. Files missing every referenced tag fall
+back to the default naming. With --deid-profile, files are excluded instead when they have no --subject, or when
+their subject would be a PatientID that the profile removes.
+
+With --subject-map, subject codes come from a CSV of PatientID,subject code instead, and --unmapped decides what
+happens to patients missing from it. The map does not change the files; remove PatientID with --deid-profile.
+
+Series the project already has, matched by uid, are skipped by default. With --existing append, only SOP instances
+the server does not have are uploaded, as a new file, and series whose zip members are not named by SOP Instance UID
+fail; with --existing replace the whole series is uploaded again.
+Acquisitions are uploaded --jobs at a time and retried on failure, so rerunning an import that partly failed only
+uploads what is missing.
+
+Every series is its own acquisition unless related acquisitions are asked for. --related-acq groups the series of a
+study that share a FrameOfReferenceUID, and --related-series groups series by SeriesNumber range. Grouped series
+keep the uid and label of their lowest-numbered series. --split-by then splits an acquisition into one per value of
+the given tags; with --related-acq it defaults to EchoNumbers and TemporalPositionIdentifier, which separates the
+echoes and phases of multi-echo and dynamic series.
+
+Each acquisition is uploaded as a zip with its files in InstanceNumber order, named {Modality}.{SOPInstanceUID}.dcm
+by default; --zip-naming original keeps their paths below the imported folder instead. With --compression auto,
+files with an already compressed transfer syntax are stored rather than deflated. The same files always produce
+the same zip.
+
+Each series is checked for gaps in InstanceNumber, fewer images than ImagesInAcquisition announces, and mixed
+modalities or image sizes, as happens with partial PACS exports. Problems are shown as warnings in the tree; with
+--require-complete, such series are held back from the upload and listed instead.
+
+Files that are not DICOM are listed by kind. With --attach-other, PDFs, images and text files are uploaded to the
+session or acquisition of the DICOM files in the same folder, or the nearest folder above it with any. They are
+uploaded unchanged, so --attach-other cannot be combined with --deid-profile.
+
+  fw import dicom --session-label '{StudyDate|date}_{StudyDescription}' --acquisition-label '{SeriesNumber}-{SeriesDescription}' --subject '{PatientName}' scans/ psychology Anxiety`,
 		Args:   cobra.ExactArgs(3),
 		PreRun: o.RequireClient,
 		Run: func(cmd *cobra.Command, args []string) {
-
-			// related_acq is marked as not working, so force-set to false
-			// force-set log_level to 2; change out for a verbose flag later.
-
-			dicom.Scan(o.Client, args[0], args[1], args[2], false, quiet, noTree, local)
+			dicom.Scan(o.Client, args[0], args[1], args[2], options)
 		},
 	}
 
-	cmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Show less scan and upload progress")
-	cmd.Flags().BoolVar(&noTree, "no-tree", false, "Do not show upload summary tree")
-	cmd.Flags().BoolVarP(&local, "local", "l", false, "Save derived hierarchy locally")
+	cmd.Flags().BoolVarP(&options.Quiet, "quiet", "q", false, "Show less scan and upload progress")
+	cmd.Flags().BoolVar(&options.NoTree, "no-tree", false, "Do not show upload summary tree")
+	cmd.Flags().BoolVarP(&options.Local, "local", "l", false, "Save derived hierarchy locally")
+	cmd.Flags().StringVar(&options.ReportPath, "report", "", "Write a JSON report of the import to this file")
+	cmd.Flags().StringVar(&options.DeidProfile, "deid-profile", "", "De-identify files and labels with this YAML profile before upload")
+	cmd.Flags().StringVar(&options.OnConflict, "on-conflict", dicom.ConflictSkip, "Files sharing a SOPInstanceUID with different contents: skip, first, last or fail")
+	cmd.Flags().StringVar(&options.SessionLabel, "session-label", "", "Template for session labels, e.g. '{StudyDate|date}_{StudyDescription}'")
+	cmd.Flags().StringVar(&options.AcquisitionLabel, "acquisition-label", "", "Template for acquisition labels, e.g. '{SeriesNumber}-{SeriesDescription}'")
+	cmd.Flags().StringVar(&options.Subject, "subject", "", "Template for subject codes, e.g. '{PatientName}'")
+	cmd.Flags().StringVar(&options.SubjectMap, "subject-map", "", "CSV mapping PatientID to subject code")
+	cmd.Flags().StringVar(&options.Unmapped, "unmapped", dicom.UnmappedFail, "Patients missing from --subject-map: skip, fail or keep")
+	cmd.Flags().BoolVar(&options.RelatedAcq, "related-acq", false, "Group series sharing a frame of reference into one acquisition, split by echo and temporal position")
+	cmd.Flags().StringSliceVar(&options.RelatedSeries, "related-series", nil, "Group series whose SeriesNumber falls in a range, e.g. 2-5, into one acquisition")
+	cmd.Flags().StringSliceVar(&options.SplitBy, "split-by", nil, "Split series into one acquisition per value of these tags, e.g. EchoNumbers")
+	cmd.Flags().StringVar(&options.Existing, "existing", dicom.ExistingSkip, "Series the project already has: skip, append or replace")
+	cmd.Flags().StringVar(&options.ZipNaming, "zip-naming", dicom.ZipNamingSop, "Name acquisition zip members by original path, sop or instance-number")
+	cmd.Flags().StringVar(&options.Compression, "compression", dicom.CompressionAuto, "Zip compression: auto, store, deflate or a level from 1 to 9")
+	cmd.Flags().BoolVar(&options.RequireComplete, "require-complete", false, "Do not upload series with missing instances, or mixed modalities or image sizes")
+	cmd.Flags().StringVar(&options.AttachOther, "attach-other", dicom.AttachNone, "Upload PDFs, images and text files found with the series to their session, acquisition or none")
+	cmd.Flags().IntVarP(&options.Jobs, "jobs", "j", dicom.DefaultJobs, "Number of acquisitions to upload at once")
+	cmd.Flags().IntVar(&options.Retries, "retries", dicom.DefaultRetries, "Number of times to retry a failed acquisition upload")
+	cmd.Flags().IntVar(&options.Workers, "workers", dicom.DefaultWorkers, "Number of files to read DICOM headers from at once")
 
 	return cmd
 }
@@ -0,0 +1,164 @@
+package command
+
+import (
+	"github.com/spf13/cobra"
+
+	"flywheel.io/fw/dicom"
+	. "flywheel.io/fw/util"
+)
+
+func (o *opts) dicomCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dicom",
+		Short: "Work with DICOM files and DICOM network transfers",
+	}
+
+	cmd.AddCommand(o.dicomSort())
+	cmd.AddCommand(o.dicomInspect())
+	cmd.AddCommand(o.dicomListen())
+	cmd.AddCommand(o.dicomSend())
+
+	return cmd
+}
+
+func (o *opts) dicomSort() *cobra.Command {
+	options := &dicom.SortOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "sort [folder|archive] [output-folder]",
+		Short: "Sort DICOM files into subject/session/acquisition folders",
+		Long: `Sort DICOM files into subject/session/acquisition folders, the same way import dicom groups them, without
+logging in to Flywheel.
+
+Each file is named by its SOPInstanceUID with a .dcm extension, and each acquisition folder gets a series.json
+summarizing the series. Files are copied by default; --mode hardlink or symlink links them instead, except for
+files read from archives, which are always copied. Related series are grouped and split as with import dicom.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			dicom.Sort(args[0], args[1], options)
+		},
+	}
+
+	cmd.Flags().StringVarP(&options.Mode, "mode", "m", dicom.SortCopy, "How to place files: copy, hardlink or symlink")
+	cmd.Flags().BoolVarP(&options.Quiet, "quiet", "q", false, "Show less progress")
+	cmd.Flags().StringVar(&options.OnConflict, "on-conflict", dicom.ConflictSkip, "Files sharing a SOPInstanceUID with different contents: skip, first, last or fail")
+	cmd.Flags().StringVar(&options.SessionLabel, "session-label", "", "Template for session labels, e.g. '{StudyDate|date}_{StudyDescription}'")
+	cmd.Flags().StringVar(&options.AcquisitionLabel, "acquisition-label", "", "Template for acquisition labels, e.g. '{SeriesNumber}-{SeriesDescription}'")
+	cmd.Flags().StringVar(&options.Subject, "subject", "", "Template for subject codes, e.g. '{PatientName}'")
+	cmd.Flags().BoolVar(&options.RelatedAcq, "related-acq", false, "Group series sharing a frame of reference into one acquisition, split by echo and temporal position")
+	cmd.Flags().StringSliceVar(&options.RelatedSeries, "related-series", nil, "Group series whose SeriesNumber falls in a range, e.g. 2-5, into one acquisition")
+	cmd.Flags().StringSliceVar(&options.SplitBy, "split-by", nil, "Split series into one acquisition per value of these tags, e.g. EchoNumbers")
+	cmd.Flags().IntVar(&options.Workers, "workers", dicom.DefaultWorkers, "Number of files to read DICOM headers from at once")
+
+	return cmd
+}
+
+func (o *opts) dicomInspect() *cobra.Command {
+	options := &dicom.InspectOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "inspect [file|folder|archive]",
+		Short: "Print DICOM header tags",
+		Long: `Print the DICOM header tags of a file, or of every file in a folder or archive.
+
+Tags are named by keyword or hex, e.g. --tag PatientName,SeriesNumber or --tag 0020000E. With --group-by, files
+are summarized by the values of the given tags instead, along with the distinct values of any --tag:
+
+  fw dicom inspect --group-by StudyInstanceUID,SeriesInstanceUID --tag SeriesDescription scans/`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			dicom.Inspect(args[0], options)
+		},
+	}
+
+	cmd.Flags().StringSliceVarP(&options.Tags, "tag", "t", nil, "Tags to show; all tags if not given")
+	cmd.Flags().StringSliceVar(&options.GroupBy, "group-by", nil, "Summarize files by these tags")
+	cmd.Flags().BoolVar(&options.Json, "json", false, "Print JSON instead of a table")
+
+	return cmd
+}
+
+func (o *opts) dicomListen() *cobra.Command {
+	options := &dicom.ListenOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "listen [group-id] [project-label]",
+		Short: "Receive DICOM from a scanner or PACS and import it",
+		Long: `Run a DICOM C-STORE receiver that imports what it receives into a project.
+
+Instances are buffered in --spool by study. Once a study has gone --quiet-period without new instances, all of its
+series are sorted and uploaded together the same way import dicom would, so related series can be grouped and split,
+and what was uploaded is removed from the spool. Series held back by --require-complete or that fail to upload are
+kept there, and imported again with the rest of the study if more of it arrives. On Ctrl-C, pending studies are
+imported before exiting; press Ctrl-C again to stop at once.
+
+Associations must be addressed to --ae-title. Series the project already has are appended to by default, so
+instances sent again later only add what is missing. To try it out without a scanner:
+
+  fw dicom listen --port 11112 psychology Anxiety
+  fw dicom send --called-ae FW localhost:11112 scans/`,
+		Args:   cobra.ExactArgs(2),
+		PreRun: o.RequireClient,
+		Run: func(cmd *cobra.Command, args []string) {
+			dicom.Listen(o.Client, args[0], args[1], options)
+		},
+	}
+
+	cmd.Flags().IntVar(&options.Port, "port", dicom.DefaultPort, "TCP port to listen on")
+	cmd.Flags().StringVar(&options.AETitle, "ae-title", dicom.DefaultAETitle, "AE title to accept associations for")
+	cmd.Flags().DurationVar(&options.QuietPeriod, "quiet-period", dicom.DefaultQuietPeriod, "Import a study once it has received nothing for this long")
+	cmd.Flags().StringVar(&options.Spool, "spool", "", "Folder to buffer received instances in; a temporary folder if not given")
+	cmd.Flags().BoolVarP(&options.Quiet, "quiet", "q", false, "Show less upload progress")
+	cmd.Flags().BoolVar(&options.NoTree, "no-tree", false, "Do not show the tree of each imported study")
+	cmd.Flags().StringVar(&options.ReportPath, "report", "", "Write a JSON report of everything imported to this file on exit")
+	cmd.Flags().StringVar(&options.DeidProfile, "deid-profile", "", "De-identify files and labels with this YAML profile before upload")
+	cmd.Flags().StringVar(&options.OnConflict, "on-conflict", dicom.ConflictSkip, "Files sharing a SOPInstanceUID with different contents: skip, first, last or fail")
+	cmd.Flags().StringVar(&options.SessionLabel, "session-label", "", "Template for session labels, e.g. '{StudyDate|date}_{StudyDescription}'")
+	cmd.Flags().StringVar(&options.AcquisitionLabel, "acquisition-label", "", "Template for acquisition labels, e.g. '{SeriesNumber}-{SeriesDescription}'")
+	cmd.Flags().StringVar(&options.Subject, "subject", "", "Template for subject codes, e.g. '{PatientName}'")
+	cmd.Flags().StringVar(&options.SubjectMap, "subject-map", "", "CSV mapping PatientID to subject code")
+	cmd.Flags().StringVar(&options.Unmapped, "unmapped", dicom.UnmappedFail, "Patients missing from --subject-map: skip, fail or keep")
+	cmd.Flags().BoolVar(&options.RelatedAcq, "related-acq", false, "Group series sharing a frame of reference into one acquisition, split by echo and temporal position")
+	cmd.Flags().StringSliceVar(&options.RelatedSeries, "related-series", nil, "Group series whose SeriesNumber falls in a range, e.g. 2-5, into one acquisition")
+	cmd.Flags().StringSliceVar(&options.SplitBy, "split-by", nil, "Split series into one acquisition per value of these tags, e.g. EchoNumbers")
+	cmd.Flags().StringVar(&options.Existing, "existing", dicom.ExistingAppend, "Series the project already has: skip, append or replace")
+	cmd.Flags().StringVar(&options.ZipNaming, "zip-naming", dicom.ZipNamingSop, "Name acquisition zip members by original path, sop or instance-number")
+	cmd.Flags().StringVar(&options.Compression, "compression", dicom.CompressionAuto, "Zip compression: auto, store, deflate or a level from 1 to 9")
+	cmd.Flags().BoolVar(&options.RequireComplete, "require-complete", false, "Do not upload series with missing instances, or mixed modalities or image sizes")
+	cmd.Flags().IntVarP(&options.Jobs, "jobs", "j", dicom.DefaultJobs, "Number of acquisitions to upload at once")
+	cmd.Flags().IntVar(&options.Retries, "retries", dicom.DefaultRetries, "Number of times to retry a failed acquisition upload")
+
+	return cmd
+}
+
+func (o *opts) dicomSend() *cobra.Command {
+	var callingAE string
+	var calledAE string
+	var echo bool
+
+	cmd := &cobra.Command{
+		Use:   "send [host:port] [file|folder...]",
+		Short: "Send DICOM files to a DICOM receiver",
+		Long: `Send DICOM files to a C-STORE receiver, such as fw dicom listen, over a single association.
+
+Only DICOM files with file meta information (a DICM header) are sent; anything else is skipped.
+With --echo, only checks that the receiver accepts associations, and no files are needed.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if echo {
+				dicom.Echo(args[0], calledAE, callingAE)
+				return
+			}
+			if len(args) < 2 {
+				FatalWithMessage("Give files or folders to send, or --echo to check the connection.")
+			}
+			dicom.Send(args[0], calledAE, callingAE, args[1:])
+		},
+	}
+
+	cmd.Flags().StringVar(&callingAE, "ae-title", "FWSCU", "AE title to send as")
+	cmd.Flags().StringVar(&calledAE, "called-ae", dicom.DefaultAETitle, "AE title of the receiver")
+	cmd.Flags().BoolVar(&echo, "echo", false, "Send a C-ECHO instead of files")
+
+	return cmd
+}
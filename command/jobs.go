@@ -1,9 +1,14 @@
 package command
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
 
+	"flywheel.io/sdk/api"
+
 	"flywheel.io/fw/ops"
+	. "flywheel.io/fw/util"
 )
 
 func (o *opts) job() *cobra.Command {
@@ -16,10 +21,13 @@ func (o *opts) job() *cobra.Command {
 	cmd.AddCommand(o.jobRun())
 	cmd.AddCommand(o.jobStatus())
 	cmd.AddCommand(o.jobWait())
+	cmd.AddCommand(o.jobLogs())
+	cmd.AddCommand(o.jobList())
+	cmd.AddCommand(o.jobCancel())
+	cmd.AddCommand(o.jobRetry())
+	cmd.AddCommand(o.jobOutputs())
 	cmd.AddCommand(o.jobListGears())
 
-	AddDelegateCommand(cmd, "retry", "Retry failed or completed job(s)")
-
 	return cmd
 }
 
@@ -64,15 +72,181 @@ func (o *opts) jobStatus() *cobra.Command {
 }
 
 func (o *opts) jobWait() *cobra.Command {
+	waitOpts := &ops.JobWaitOptions{}
+
 	cmd := &cobra.Command{
-		Use:   "wait [job-id]",
-		Short: "Wait for a job to finish.",
-		Args:  cobra.ExactArgs(1),
+		Use:   "wait [job-ids...]",
+		Short: "Wait for jobs to finish.",
+		Long: `Wait for jobs to finish: those given by id, the jobs of a batch, or the jobs with a tag.
+
+While waiting for several jobs, each change of state is printed along with a count of jobs in each state.
+Polling starts every --interval and slows down while nothing changes, up to --max-interval. With --logs, the log
+is checked on the same schedule, and polling speeds up again whenever new output appears.
+
+The exit code is 0 if every job completed, 1 if any failed, 2 if any was cancelled and none failed, and 3 if the
+--timeout passed before every job finished.
+
+The jobs with a --tag are found by asking the server for them; servers that cannot filter jobs by tag list every
+job instead, which can take a while on a busy site.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			ops.JobWait(o.Client, args[0])
+			if len(args) == 0 && waitOpts.Batch == "" && waitOpts.Tag == "" {
+				FatalWithMessage("Give job ids, --batch or --tag.")
+			}
+			waitOpts.Ids = args
+			ops.JobWait(o.Client, waitOpts)
 		},
 	}
 
+	cmd.Flags().StringVar(&waitOpts.Batch, "batch", "", "Wait for the jobs of this batch")
+	cmd.Flags().StringVar(&waitOpts.Tag, "tag", "", "Wait for the jobs with this tag")
+	cmd.Flags().DurationVar(&waitOpts.Timeout, "timeout", 0, "Give up after this long, e.g. 2h; 0 waits forever")
+	cmd.Flags().DurationVar(&waitOpts.Interval, "interval", 10*time.Second, "How often to check at first")
+	cmd.Flags().DurationVar(&waitOpts.MaxInterval, "max-interval", 2*time.Minute, "How often to check at most, once polling has slowed down")
+	cmd.Flags().BoolVar(&waitOpts.FailFast, "fail-fast", false, "Stop as soon as any job fails or is cancelled")
+	cmd.Flags().BoolVar(&waitOpts.Logs, "logs", false, "Print the job's log while waiting; only for a single job")
+
+	return cmd
+}
+
+func (o *opts) jobLogs() *cobra.Command {
+	var follow bool
+	var timestamps bool
+
+	cmd := &cobra.Command{
+		Use:   "logs [job-id]",
+		Short: "Print the log of a job.",
+		Long: `Print the engine log of a job. The gear's stdout is printed to stdout, and its stderr and messages from the
+engine to stderr.
+
+With --follow, new output is printed as it arrives until the job finishes; the exit code is then 0 if the job
+completed and 1 if it failed or was cancelled.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			ops.JobLogs(o.Client, args[0], follow, timestamps)
+		},
+	}
+
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "Keep printing new output until the job finishes")
+	cmd.Flags().BoolVarP(&timestamps, "timestamps", "t", false, "Prefix each line with the time it was logged, or dashes if the engine did not record one")
+
+	return cmd
+}
+
+// addJobFilterFlags adds the flags that select jobs by their properties.
+func addJobFilterFlags(cmd *cobra.Command, filter *ops.JobFilter) {
+	cmd.Flags().StringSliceVar(&filter.States, "state", nil, "Only jobs in these states: pending, running, failed, complete or cancelled")
+	cmd.Flags().StringVar(&filter.Gear, "gear", "", "Only jobs of this gear, given as name or name:version")
+	cmd.Flags().StringSliceVar(&filter.Tags, "tag", nil, "Only jobs with this tag; repeat to require several")
+	cmd.Flags().StringVar(&filter.Origin, "origin", "", "Only jobs started by this user or job id, or by this kind of origin such as system")
+	cmd.Flags().StringVar(&filter.Destination, "destination", "", "Only jobs whose destination is this container path or is inside it")
+	cmd.Flags().StringVar(&filter.Since, "since", "", "Only jobs created after this date, time or duration ago, e.g. 2006-01-02 or 7d")
+	cmd.Flags().StringVar(&filter.Until, "until", "", "Only jobs created before this date, time or duration ago")
+}
+
+func (o *opts) jobList() *cobra.Command {
+	filter := &ops.JobFilter{}
+	var format string
+	var limit int
+	var page int
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List jobs.",
+		Long: `List jobs, newest first, optionally filtered by state, gear, tag, origin, destination and creation time.
+
+Examples:
+  fw job list --state failed --since 24h
+  fw job list --gear dcm2niix:1.0.0 --destination my-group/my-project --format csv`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ops.ListJobs(o.Client, filter, format, limit, page)
+		},
+	}
+
+	addJobFilterFlags(cmd, filter)
+	cmd.Flags().StringVar(&format, "format", ops.FormatTable, "Output format: table, json or csv")
+	cmd.Flags().IntVar(&limit, "limit", 50, "Most jobs to list")
+	cmd.Flags().IntVar(&page, "page", 1, "Which page of --limit jobs to list")
+
+	return cmd
+}
+
+func (o *opts) jobCancel() *cobra.Command {
+	filter := &ops.JobFilter{}
+	var yes bool
+
+	cmd := &cobra.Command{
+		Use:   "cancel [job-ids...]",
+		Short: "Cancel pending or running jobs.",
+		Long: `Cancel jobs given by id, or every job matching the filters. Filtering without --state selects pending and
+running jobs. The jobs are listed for confirmation first, then a line of JSON is printed for each job.
+
+Examples:
+  fw job cancel 5c1a3e2f8e2b4a001c7d9f10
+  fw job cancel --gear dcm2niix --tag nightly --yes`,
+		Run: func(cmd *cobra.Command, args []string) {
+			ops.CancelJobs(o.Client, args, filter, yes)
+		},
+	}
+
+	addJobFilterFlags(cmd, filter)
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Do not ask for confirmation")
+
+	return cmd
+}
+
+func (o *opts) jobRetry() *cobra.Command {
+	filter := &ops.JobFilter{}
+	var failedSince string
+	var includeComplete bool
+	var yes bool
+
+	cmd := &cobra.Command{
+		Use:   "retry [job-ids...]",
+		Short: "Retry failed jobs.",
+		Long: `Retry jobs given by id, or every job matching the filters. Filtering without --state selects failed jobs.
+The jobs are listed for confirmation first, then a line of JSON is printed for each job with the id of its retry.
+
+Examples:
+  fw job retry 5c1a3e2f8e2b4a001c7d9f10
+  fw job retry --failed-since 24h --gear dcm2niix`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if failedSince != "" {
+				filter.States = append(filter.States, string(api.Failed))
+				filter.Since = failedSince
+			}
+			ops.RetryJobs(o.Client, args, filter, includeComplete, yes)
+		},
+	}
+
+	addJobFilterFlags(cmd, filter)
+	cmd.Flags().StringVar(&failedSince, "failed-since", "", "Retry jobs that failed since this date, time or duration ago; short for --state failed --since")
+	cmd.Flags().BoolVar(&includeComplete, "include-complete", false, "Also retry completed jobs")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Do not ask for confirmation")
+
+	return cmd
+}
+
+func (o *opts) jobOutputs() *cobra.Command {
+	var dir string
+	var wait bool
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "outputs [job-id]",
+		Short: "Download the files a job produced.",
+		Long: `Download the files a job produced: those it saved to its destination container, or the outputs of its
+analysis.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			ops.JobOutputs(o.Client, args[0], dir, wait, force)
+		},
+	}
+
+	cmd.Flags().StringVarP(&dir, "output", "o", ".", "Folder to download into")
+	cmd.Flags().BoolVar(&wait, "wait", false, "Wait for the job to finish first")
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Overwrite files that already exist")
+
 	return cmd
 }
 
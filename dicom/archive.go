@@ -0,0 +1,452 @@
+package dicom
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// is_archive reports whether a path names an archive that can be imported in place of a folder.
+func is_archive(name string) bool {
+	return is_zip(name) || is_tar(name)
+}
+
+func is_zip(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".zip")
+}
+
+func is_tar(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, ".tar") || strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz")
+}
+
+// Zip archives stay open for the whole import, so members can be read again at upload time
+var zipArchives = map[string]*zipArchive{}
+var zipArchivesMutex sync.Mutex
+
+type zipArchive struct {
+	*zip.ReadCloser
+	members map[string]*zip.File
+}
+
+func open_zip(archive string) (*zipArchive, error) {
+	zipArchivesMutex.Lock()
+	defer zipArchivesMutex.Unlock()
+
+	if x, ok := zipArchives[archive]; ok {
+		return x, nil
+	}
+
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &zipArchive{ReadCloser: reader, members: map[string]*zip.File{}}
+	for _, file := range reader.File {
+		x.members[file.Name] = file
+	}
+	zipArchives[archive] = x
+	return x, nil
+}
+
+// Tar archives are indexed once per import. Members of a plain tar are read in place from their offset;
+// compressed tars cannot be seeked, so their members are read from the stream into memory, one at a time,
+// re-opening the stream to go back to an earlier member. Nothing is extracted to disk.
+var tarArchives = map[string]*tarArchive{}
+var tarArchivesMutex sync.Mutex
+
+type tarArchive struct {
+	path string
+
+	// Open for plain tars
+	file *os.File
+
+	order   []*tarMember
+	members map[string]*tarMember
+
+	// Shared position in a compressed tar, for reading members out of walk order
+	mutex  sync.Mutex
+	stream *tarStream
+}
+
+type tarMember struct {
+	name    string
+	modTime time.Time
+	offset  int64
+	size    int64
+	index   int // Position among the regular members
+}
+
+// tarStream reads the regular members of a tar in order.
+type tarStream struct {
+	file   *os.File
+	gz     *gzip.Reader
+	reader *tar.Reader
+	next   int // Index of the member the next call to Next returns
+}
+
+func open_tar(archive string) (*tarArchive, error) {
+	tarArchivesMutex.Lock()
+	defer tarArchivesMutex.Unlock()
+
+	if x, ok := tarArchives[archive]; ok {
+		return x, nil
+	}
+
+	x, err := index_tar(archive)
+	if err != nil {
+		return nil, err
+	}
+	tarArchives[archive] = x
+	return x, nil
+}
+
+func is_compressed_tar(archive string) bool {
+	lower := strings.ToLower(archive)
+	return strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz")
+}
+
+func open_tar_stream(archive string) (*tarStream, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &tarStream{file: file, gz: gz, reader: tar.NewReader(gz)}, nil
+}
+
+// Next skips to the next regular member, returning io.EOF after the last.
+func (s *tarStream) Next() (*tar.Header, error) {
+	for {
+		header, err := s.reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			s.next++
+			return header, nil
+		}
+	}
+}
+
+func (s *tarStream) Close() error {
+	s.gz.Close()
+	return s.file.Close()
+}
+
+// index_tar reads a tar archive once, recording its regular members and, for plain tars, where each starts.
+func index_tar(archive string) (*tarArchive, error) {
+	x := &tarArchive{path: archive, members: map[string]*tarMember{}}
+
+	var next func() (*tar.Header, error)
+	var file *os.File
+	if is_compressed_tar(archive) {
+		stream, err := open_tar_stream(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer stream.Close()
+		next = stream.Next
+	} else {
+		var err error
+		file, err = os.Open(archive)
+		if err != nil {
+			return nil, err
+		}
+		x.file = file
+		stream := &tarStream{reader: tar.NewReader(file)}
+		next = stream.Next
+	}
+
+	for {
+		header, err := next()
+		if err == io.EOF {
+			return x, nil
+		} else if err != nil {
+			x.Close()
+			return nil, err
+		}
+
+		member := &tarMember{name: header.Name, modTime: header.ModTime, size: header.Size, index: len(x.order)}
+		if file != nil {
+			// Headers are read block by block, so the file is now at the start of the member's contents
+			member.offset, err = file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				x.Close()
+				return nil, err
+			}
+		}
+
+		x.order = append(x.order, member)
+		x.members[header.Name] = member
+	}
+}
+
+func (x *tarArchive) open(member *tarMember) (io.ReadCloser, error) {
+	if x.file != nil {
+		return ioutil.NopCloser(io.NewSectionReader(x.file, member.offset, member.size)), nil
+	}
+	data, err := x.read(member)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (x *tarArchive) read(member *tarMember) ([]byte, error) {
+	if x.file != nil {
+		reader, _ := x.open(member)
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.stream != nil && x.stream.next > member.index {
+		x.stream.Close()
+		x.stream = nil
+	}
+	if x.stream == nil {
+		stream, err := open_tar_stream(x.path)
+		if err != nil {
+			return nil, err
+		}
+		x.stream = stream
+	}
+
+	for {
+		_, err := x.stream.Next()
+		if err == io.EOF {
+			return nil, errors.New(x.path + ": member " + member.name + " not found")
+		} else if err != nil {
+			return nil, err
+		}
+		if x.stream.next-1 == member.index {
+			return ioutil.ReadAll(x.stream.reader)
+		}
+	}
+}
+
+func (x *tarArchive) Close() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.stream != nil {
+		x.stream.Close()
+		x.stream = nil
+	}
+	if x.file != nil {
+		return x.file.Close()
+	}
+	return nil
+}
+
+// walkArchive sends every member of an archive without extracting it.
+// Members listed in a DICOMDIR are the only ones sent from its folder when one is present.
+func walkArchive(archive string, paths chan<- walkedFile, order *int) error {
+	if is_zip(archive) {
+		return walkZip(archive, paths, order)
+	}
+	return walkTar(archive, paths, order)
+}
+
+func walkZip(archive string, paths chan<- walkedFile, order *int) error {
+	x, err := open_zip(archive)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, file := range x.File {
+		names = append(names, file.Name)
+	}
+	indexes := read_dicomdirs(archive, names, func(name string) ([]byte, error) {
+		return read_zip_member(x.members[name])
+	})
+
+	for _, file := range x.File {
+		name := file.Name
+		if file.FileInfo().IsDir() || is_dicomdir(name) {
+			continue
+		}
+		if !listed(indexes, name) {
+			skip_unlisted(archive + "/" + name)
+			continue
+		}
+
+		member := file
+		paths <- walkedFile{
+			path:    archive + "/" + name,
+			order:   *order,
+			rel:     name,
+			archive: archive,
+			member:  name,
+			modTime: file.Modified,
+			open: func() (io.ReadCloser, error) {
+				return member.Open()
+			},
+		}
+		*order++
+	}
+	return nil
+}
+
+func walkTar(archive string, paths chan<- walkedFile, order *int) error {
+	x, err := open_tar(archive)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, member := range x.order {
+		names = append(names, member.name)
+	}
+	indexes := read_dicomdirs(archive, names, func(name string) ([]byte, error) {
+		return x.read(x.members[name])
+	})
+
+	// Compressed members are read from a stream of their own as it is walked, and held in memory until parsed
+	var stream *tarStream
+	if x.file == nil {
+		stream, err = open_tar_stream(archive)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+	}
+
+	for _, member := range x.order {
+		if stream != nil {
+			_, err = stream.Next()
+			if err != nil {
+				return err
+			}
+		}
+
+		if is_dicomdir(member.name) {
+			continue
+		}
+		if !listed(indexes, member.name) {
+			skip_unlisted(archive + "/" + member.name)
+			continue
+		}
+
+		member := member
+		open := func() (io.ReadCloser, error) {
+			return x.open(member)
+		}
+		if stream != nil {
+			data, err := ioutil.ReadAll(stream.reader)
+			if err != nil {
+				return err
+			}
+			open = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(data)), nil
+			}
+		}
+
+		paths <- walkedFile{
+			path:    archive + "/" + member.name,
+			order:   *order,
+			rel:     member.name,
+			archive: archive,
+			member:  member.name,
+			modTime: member.modTime,
+			open:    open,
+		}
+		*order++
+	}
+	return nil
+}
+
+// read_dicomdirs loads the DICOMDIRs among an archive's members, keyed by the folder each is in.
+func read_dicomdirs(archive string, names []string, read func(name string) ([]byte, error)) map[string]dicomdirIndex {
+	indexes := map[string]dicomdirIndex{}
+	for _, name := range names {
+		if !is_dicomdir(name) {
+			continue
+		}
+		data, err := read(name)
+		if err == nil {
+			var index dicomdirIndex
+			index, err = parse_dicomdir(data)
+			if err == nil {
+				indexes[path.Dir(name)] = index
+			}
+		}
+		if err != nil {
+			exclude(archive+"/"+name, "", "could not read DICOMDIR: "+err.Error(), true)
+		}
+	}
+	return indexes
+}
+
+func read_zip_member(file *zip.File) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// open_source opens a file's contents, whether it is loose on disk or a member of an archive.
+func open_source(file DicomFile) (io.ReadCloser, error) {
+	if file.Archive == "" {
+		return os.Open(file.Path)
+	}
+
+	if is_zip(file.Archive) {
+		x, err := open_zip(file.Archive)
+		if err != nil {
+			return nil, err
+		}
+		member, ok := x.members[file.Member]
+		if !ok {
+			return nil, errors.New(file.Archive + ": member " + file.Member + " not found")
+		}
+		return member.Open()
+	}
+
+	x, err := open_tar(file.Archive)
+	if err != nil {
+		return nil, err
+	}
+	member, ok := x.members[file.Member]
+	if !ok {
+		return nil, errors.New(file.Archive + ": member " + file.Member + " not found")
+	}
+	return x.open(member)
+}
+
+// close_archives releases every archive opened during the import.
+func close_archives() {
+	zipArchivesMutex.Lock()
+	for name, x := range zipArchives {
+		x.Close()
+		delete(zipArchives, name)
+	}
+	zipArchivesMutex.Unlock()
+
+	tarArchivesMutex.Lock()
+	for name, x := range tarArchives {
+		x.Close()
+		delete(tarArchives, name)
+	}
+	tarArchivesMutex.Unlock()
+}
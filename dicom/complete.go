@@ -0,0 +1,171 @@
+package dicom
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	tag "github.com/grailbio/go-dicom/dicomtag"
+
+	. "flywheel.io/fw/util"
+)
+
+// Most missing InstanceNumbers listed in a warning before the rest are only counted
+const maxGapsListed = 5
+
+// Reading stops here when only completeness_tags are needed past the usual header cut off. BitsAllocated follows
+// Rows and Columns and is present in every image.
+var completenessStop = tag.BitsAllocated
+
+// completeness_tags are the tags check_series reads.
+func completeness_tags() []tag.Tag {
+	return []tag.Tag{tag.ImagesInAcquisition, tag.NumberOfFrames, tag.Rows, tag.Columns}
+}
+
+// check_series warns about acquisitions that look partially copied or mixed: gaps in InstanceNumber,
+// fewer images than ImagesInAcquisition announces, and more than one modality or image size.
+func check_series(sessions map[string]Session) {
+	for _, session := range sessions {
+		for _, acq := range session.Acquisitions {
+			acq.Warnings = series_warnings(acq)
+		}
+	}
+}
+
+func series_warnings(acq *Acquisition) []string {
+	var warnings []string
+	var numbers []int
+	modalities := map[string]bool{}
+	sizes := map[string]bool{}
+	images, expected := 0, 0
+
+	for _, file := range acq.Files {
+		if n, ok := instance_number(file); ok {
+			numbers = append(numbers, n)
+		}
+
+		if value := find_value(file, tag.TagInfo{Tag: tag.Modality}); value != "" {
+			modalities[value] = true
+		}
+
+		rows := find_value(file, tag.TagInfo{Tag: tag.Rows})
+		columns := find_value(file, tag.TagInfo{Tag: tag.Columns})
+		if rows != "" && columns != "" {
+			sizes[columns+"x"+rows] = true
+		}
+
+		// Multi-frame files hold several images each
+		frames, err := strconv.Atoi(find_value(file, tag.TagInfo{Tag: tag.NumberOfFrames}))
+		if err != nil || frames < 1 {
+			frames = 1
+		}
+		images += frames
+
+		if n, err := strconv.Atoi(find_value(file, tag.TagInfo{Tag: tag.ImagesInAcquisition})); err == nil && n > expected {
+			expected = n
+		}
+	}
+
+	if listed, missing := instance_gaps(numbers); missing > 0 {
+		warnings = append(warnings, gaps_warning(listed, missing))
+	}
+	if expected > images {
+		warnings = append(warnings, fmt.Sprintf("has %d of the %d images in ImagesInAcquisition", images, expected))
+	}
+	if len(modalities) > 1 {
+		warnings = append(warnings, "mixes modalities "+strings.Join(sorted_keys(modalities), ", "))
+	}
+	if len(sizes) > 1 {
+		warnings = append(warnings, "mixes image sizes "+strings.Join(sorted_keys(sizes), ", "))
+	}
+	return warnings
+}
+
+// instance_gaps counts the InstanceNumbers missing between the lowest and highest found, listing the first few.
+func instance_gaps(numbers []int) ([]int, int) {
+	if len(numbers) < 2 {
+		return nil, 0
+	}
+	sort.Ints(numbers)
+
+	var listed []int
+	missing := 0
+	for i := 1; i < len(numbers); i++ {
+		for n := numbers[i-1] + 1; n < numbers[i]; n++ {
+			if len(listed) < maxGapsListed {
+				listed = append(listed, n)
+			}
+			missing++
+		}
+	}
+	return listed, missing
+}
+
+func gaps_warning(listed []int, missing int) string {
+	var values []string
+	for _, n := range listed {
+		values = append(values, strconv.Itoa(n))
+	}
+	if missing > len(listed) {
+		values = append(values, fmt.Sprintf("and %d more", missing-len(listed)))
+	}
+	return fmt.Sprintf("is missing %d instances by InstanceNumber: %s", missing, strings.Join(values, ", "))
+}
+
+func sorted_keys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hold_incomplete removes acquisitions with warnings from the upload, recording each as skipped with an error.
+// Returns a line per acquisition held back.
+func hold_incomplete(sessions map[string]Session) []string {
+	var held []string
+
+	for study_uid, session := range sessions {
+		for series_uid, acq := range session.Acquisitions {
+			if len(acq.Warnings) == 0 {
+				continue
+			}
+
+			reason := "incomplete series: " + strings.Join(acq.Warnings, "; ")
+			held = append(held, session.SdkSession.Name+"/"+acq.SdkAcquisition.Name+": "+strings.Join(acq.Warnings, "; "))
+			importReport.AddContainer(&ReportContainer{
+				Type:   "acquisition",
+				Label:  acq.SdkAcquisition.Name,
+				Status: ContainerSkipped,
+				Error:  reason,
+			})
+
+			delete(session.Acquisitions, series_uid)
+			acquisitions_found--
+			atomic.AddInt64(&dicoms_found, -int64(len(acq.Files)))
+		}
+		if len(session.Acquisitions) == 0 {
+			delete(sessions, study_uid)
+			sessions_found--
+		}
+	}
+
+	sort.Strings(held)
+	return held
+}
+
+// printIncomplete lists the acquisitions held back by --require-complete.
+func printIncomplete(held []string) {
+	if len(held) == 0 {
+		return
+	}
+
+	fmt.Println("Holding back", len(held), "incomplete series:")
+	for _, x := range held {
+		fmt.Println("  " + x)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,160 @@
+package dicom
+
+import (
+	"errors"
+	"fmt"
+	fp "path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/udhos/equalfile"
+
+	. "flywheel.io/fw/util"
+)
+
+// Policies for files that share a SOPInstanceUID but differ in content.
+const (
+	// Exclude every file with the conflicting SOPInstanceUID
+	ConflictSkip = "skip"
+
+	// Keep the file found first in walk order
+	ConflictFirst = "first"
+
+	// Keep the file found last in walk order
+	ConflictLast = "last"
+
+	// Stop before uploading if any file was excluded
+	ConflictFail = "fail"
+)
+
+var conflictPolicy = ConflictSkip
+
+// SOPInstanceUIDs excluded under the skip policy; later copies are excluded as well
+var conflicted = map[string]bool{}
+
+// Exclusion is a file left out of the upload, and why.
+type Exclusion struct {
+	Path           string
+	SOPInstanceUID string
+	Reason         string
+
+	// Unreadable files count as failures in the import report; conflicts are only skipped
+	Failed bool
+}
+
+var exclusions []*Exclusion
+var exclusionsMutex sync.Mutex
+
+func setConflictPolicy(policy string) error {
+	switch policy {
+	case "":
+		conflictPolicy = ConflictSkip
+	case ConflictSkip, ConflictFirst, ConflictLast, ConflictFail:
+		conflictPolicy = policy
+	default:
+		return errors.New("Unknown conflict policy " + policy + "; use " + ConflictSkip + ", " + ConflictFirst + ", " + ConflictLast + " or " + ConflictFail)
+	}
+	return nil
+}
+
+// exclude records a file that will not be uploaded. Safe for concurrent use.
+func exclude(path, sop, reason string, failed bool) {
+	exclusionsMutex.Lock()
+	exclusions = append(exclusions, &Exclusion{Path: path, SOPInstanceUID: sop, Reason: reason, Failed: failed})
+	exclusionsMutex.Unlock()
+
+	status := FileSkipped
+	if failed {
+		status = FileFailed
+	}
+	importReport.AddFile(&ReportFile{
+		Name:   fp.Base(path),
+		Path:   path,
+		Status: status,
+		Error:  reason,
+	})
+}
+
+// resolve_conflict decides which of two files with the same SOPInstanceUID stays in the acquisition.
+// Identical copies are silently collapsed into one.
+func resolve_conflict(acq *Acquisition, sop string, existing_file, file DicomFile) {
+	equal, err := same_contents(existing_file, file)
+	if err != nil {
+		exclude(file.Path, sop, "could not compare with "+existing_file.Path+": "+err.Error(), true)
+		return
+	}
+	if equal {
+		return
+	}
+
+	reason := "same SOPInstanceUID as %s, but contents differ"
+
+	switch conflictPolicy {
+	case ConflictFirst, ConflictLast:
+		keep, drop := existing_file, file
+		if (conflictPolicy == ConflictFirst) == (file.order < existing_file.order) {
+			keep, drop = file, existing_file
+		}
+		acq.Files[sop] = keep
+		exclude(drop.Path, sop, fmt.Sprintf(reason+"; kept the %s file", keep.Path, conflictPolicy), false)
+
+	default:
+		delete(acq.Files, sop)
+		conflicted[sop] = true
+		atomic.AddInt64(&dicoms_found, -1)
+		exclude(existing_file.Path, sop, fmt.Sprintf(reason, file.Path), false)
+		exclude(file.Path, sop, fmt.Sprintf(reason, existing_file.Path), false)
+	}
+}
+
+// same_contents compares two files byte for byte, wherever they were read from.
+func same_contents(a, b DicomFile) (bool, error) {
+	ra, err := open_source(a)
+	if err != nil {
+		return false, err
+	}
+	defer ra.Close()
+
+	rb, err := open_source(b)
+	if err != nil {
+		return false, err
+	}
+	defer rb.Close()
+
+	cmp := equalfile.New(nil, equalfile.Options{})
+	return cmp.CompareReader(ra, rb)
+}
+
+// prune_empty drops acquisitions and sessions left without files after conflicts were excluded.
+func prune_empty(sessions map[string]Session) {
+	for study_uid, session := range sessions {
+		for series_uid, acq := range session.Acquisitions {
+			if len(acq.Files) == 0 {
+				delete(session.Acquisitions, series_uid)
+				acquisitions_found--
+			}
+		}
+		if len(session.Acquisitions) == 0 {
+			delete(sessions, study_uid)
+			sessions_found--
+		}
+	}
+}
+
+// printExclusions summarizes every file left out of the upload.
+func printExclusions() {
+	if len(exclusions) == 0 {
+		return
+	}
+
+	sort.Slice(exclusions, func(i, j int) bool {
+		return exclusions[i].Path < exclusions[j].Path
+	})
+
+	fmt.Println("Excluded", len(exclusions), "files:")
+	for _, x := range exclusions {
+		fmt.Println("  " + x.Path + ": " + x.Reason)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,624 @@
+package dicom
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	tag "github.com/grailbio/go-dicom/dicomtag"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// De-identification actions, named as in the profile.
+const (
+	DeidRemove        = "remove"
+	DeidReplace       = "replace-with"
+	DeidHash          = "hash"
+	DeidIncrementDate = "increment-date"
+)
+
+// DeidProfile describes how DICOM tags are de-identified before upload. Example:
+//
+//	name: irb-1234
+//	dicom:
+//	  date-increment: -17
+//	  salt: some-secret
+//	  fields:
+//	    - name: PatientName
+//	      replace-with: REDACTED
+//	    - name: PatientBirthDate
+//	      remove: true
+//	    - name: AccessionNumber
+//	      hash: true
+//	    - name: StudyDate
+//	      increment-date: true
+//
+// Only top-level elements are changed; sequences are copied unmodified. Profiles that hash must set a salt, which
+// should be kept secret and reused so the same value hashes the same way across imports.
+type DeidProfile struct {
+	Name  string           `yaml:"name"`
+	Dicom DeidDicomProfile `yaml:"dicom"`
+
+	fields  map[tag.Tag]*DeidField
+	byName  map[string]*DeidField
+	summary map[string]int
+	mutex   sync.Mutex
+}
+
+type DeidDicomProfile struct {
+	DateIncrement int          `yaml:"date-increment"`
+	Salt          string       `yaml:"salt"`
+	Fields        []*DeidField `yaml:"fields"`
+}
+
+type DeidField struct {
+	Name          string  `yaml:"name"`
+	Remove        bool    `yaml:"remove"`
+	ReplaceWith   *string `yaml:"replace-with"`
+	Hash          bool    `yaml:"hash"`
+	IncrementDate bool    `yaml:"increment-date"`
+
+	info tag.TagInfo
+}
+
+// LoadDeidProfile reads and validates a YAML de-identification profile.
+func LoadDeidProfile(path string) (*DeidProfile, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &DeidProfile{}
+	err = yaml.UnmarshalStrict(raw, profile)
+	if err != nil {
+		return nil, errors.New("Could not parse de-identification profile " + path + ": " + err.Error())
+	}
+
+	profile.fields = map[tag.Tag]*DeidField{}
+	profile.byName = map[string]*DeidField{}
+	profile.summary = map[string]int{}
+
+	for _, field := range profile.Dicom.Fields {
+		field.info, err = findTag(field.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		actions := 0
+		for _, set := range []bool{field.Remove, field.ReplaceWith != nil, field.Hash, field.IncrementDate} {
+			if set {
+				actions++
+			}
+		}
+		if actions != 1 {
+			return nil, errors.New("De-identification field " + field.Name + " must have exactly one action")
+		}
+
+		if field.IncrementDate && field.info.VR != "DA" && field.info.VR != "DT" {
+			return nil, errors.New("De-identification field " + field.Name + " is not a date and cannot use increment-date")
+		}
+
+		// Without a secret salt, a hash of a guessable value such as a PatientID can be reversed by brute force
+		if field.Hash && profile.Dicom.Salt == "" {
+			return nil, errors.New("De-identification field " + field.Name + " uses hash, which requires a salt in the profile")
+		}
+		if field.Hash && !hashableVR(field.info.VR) {
+			return nil, errors.New("De-identification field " + field.Name + " has binary VR " + field.info.VR + " and cannot use hash")
+		}
+
+		// File meta information is rewritten to match the data set, never set directly
+		if field.info.Tag.Group == 0x0002 {
+			return nil, errors.New("De-identification field " + field.Name + " is file meta information; de-identify the data set element it repeats instead")
+		}
+
+		// Sequences can have undefined length, and their items are not de-identified
+		if field.info.VR == "SQ" && !field.Remove {
+			return nil, errors.New("De-identification field " + field.Name + " is a sequence and can only use remove")
+		}
+
+		profile.fields[field.info.Tag] = field
+		profile.byName[field.info.Name] = field
+	}
+
+	return profile, nil
+}
+
+// findTag looks up a tag by keyword, such as PatientName, or by number, such as (0010,0010) or 00100010.
+func findTag(name string) (tag.TagInfo, error) {
+	hexName := strings.NewReplacer("(", "", ")", "", ",", "").Replace(name)
+
+	if len(hexName) == 8 {
+		group, gerr := strconv.ParseUint(hexName[:4], 16, 16)
+		element, eerr := strconv.ParseUint(hexName[4:], 16, 16)
+		if gerr == nil && eerr == nil {
+			t := tag.Tag{Group: uint16(group), Element: uint16(element)}
+			info, err := tag.Find(t)
+			if err != nil {
+				// Private and unknown tags are still usable, but their values are opaque
+				info = tag.TagInfo{Tag: t, VR: "UN", Name: name}
+			}
+			return info, nil
+		}
+	}
+
+	info, err := tag.FindByName(name)
+	if err != nil {
+		return info, errors.New("Unknown DICOM tag " + name + " in de-identification profile")
+	}
+	return info, nil
+}
+
+func (f *DeidField) action() string {
+	switch {
+	case f.Remove:
+		return DeidRemove
+	case f.ReplaceWith != nil:
+		return DeidReplace
+	case f.Hash:
+		return DeidHash
+	default:
+		return DeidIncrementDate
+	}
+}
+
+func (p *DeidProfile) count(field *DeidField) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.summary[field.info.Name+"\t"+field.action()]++
+}
+
+// apply returns the de-identified value of a single string, and false if the value should be removed.
+func (p *DeidProfile) apply(field *DeidField, vr, value string) (string, bool, error) {
+	switch field.action() {
+	case DeidRemove:
+		return "", false, nil
+
+	case DeidReplace:
+		return *field.ReplaceWith, true, nil
+
+	case DeidHash:
+		return p.hash(vr, value), true, nil
+
+	default:
+		values := strings.Split(value, "\\")
+		for i, x := range values {
+			shifted, err := shiftDate(x, p.Dicom.DateIncrement)
+			if err != nil {
+				return "", false, errors.New("Could not shift " + field.info.Name + ": " + err.Error())
+			}
+			values[i] = shifted
+		}
+		return strings.Join(values, "\\"), true, nil
+	}
+}
+
+// Hashed dates fall in the century from hashEpoch
+var hashEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const hashDays = 100 * 365
+
+// hashableVR reports whether values of a VR are text, which hash can replace.
+func hashableVR(vr string) bool {
+	switch vr {
+	case "AE", "AS", "CS", "DA", "DS", "DT", "IS", "LO", "LT", "PN", "SH", "ST", "TM", "UC", "UI", "UN", "UR", "UT":
+		return true
+	}
+	return false
+}
+
+// hash replaces a value with a salted digest, formatted to stay valid for its VR: UIDs become a UID under the
+// 2.25 root, dates and times a date or time, ages an age and numbers a number. Other text becomes 16 hex digits.
+func (p *DeidProfile) hash(vr, value string) string {
+	if value == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(p.Dicom.Salt + value))
+	n := binary.BigEndian.Uint64(sum[:8])
+
+	switch vr {
+	case "UI":
+		return "2.25." + new(big.Int).SetBytes(sum[:16]).String()
+	case "DA":
+		return hashEpoch.AddDate(0, 0, int(n%hashDays)).Format("20060102")
+	case "DT":
+		return hashEpoch.Add(time.Duration(n%(hashDays*86400)) * time.Second).Format("20060102150405")
+	case "TM":
+		return hashEpoch.Add(time.Duration(n%86400) * time.Second).Format("150405")
+	case "AS":
+		return fmt.Sprintf("%03dY", n%100)
+	case "IS", "DS":
+		return strconv.FormatUint(n%1000000000, 10)
+	case "CS":
+		// Code strings only allow upper case
+		return strings.ToUpper(hex.EncodeToString(sum[:])[:16])
+	}
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// shiftDate moves a DA or DT value by days, keeping any time component as-is.
+func shiftDate(value string, days int) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return value, nil
+	}
+	if len(value) < 8 {
+		return "", errors.New("invalid date " + value)
+	}
+
+	date, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return "", errors.New("invalid date " + value)
+	}
+
+	return date.AddDate(0, 0, days).Format("20060102") + value[8:], nil
+}
+
+// Value returns the de-identified form of a tag value read for labelling, such as the subject code.
+func (p *DeidProfile) Value(name, value string) string {
+	if p == nil {
+		return value
+	}
+
+	field, ok := p.byName[name]
+	if !ok {
+		return value
+	}
+
+	result, keep, err := p.apply(field, field.info.VR, value)
+	if err != nil || !keep {
+		return ""
+	}
+	return result
+}
+
+// PrintSummary shows how many values of each tag were changed, and how.
+func (p *DeidProfile) PrintSummary(w io.Writer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	keys := make([]string, 0, len(p.summary))
+	for key := range p.summary {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(w, "De-identification summary:")
+	tw := tabwriter.NewWriter(w, 0, 2, 2, ' ', 0)
+	for _, key := range keys {
+		fmt.Fprintf(tw, "  %s\t%d\n", key, p.summary[key])
+	}
+	if len(keys) == 0 {
+		fmt.Fprintln(tw, "  No profile tags were found in the uploaded files")
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+const (
+	undefinedLength = 0xFFFFFFFF
+
+	transferImplicitLittle = "1.2.840.10008.1.2"
+	transferExplicitBig    = "1.2.840.10008.1.2.2"
+	transferDeflated       = "1.2.840.10008.1.2.1.99"
+)
+
+var (
+	itemTag              = tag.Tag{Group: 0xFFFE, Element: 0xE000}
+	itemDelimitationTag  = tag.Tag{Group: 0xFFFE, Element: 0xE00D}
+	sequenceDelimiterTag = tag.Tag{Group: 0xFFFE, Element: 0xE0DD}
+	transferSyntaxTag    = tag.Tag{Group: 0x0002, Element: 0x0010}
+	metaGroupLengthTag   = tag.Tag{Group: 0x0002, Element: 0x0000}
+)
+
+// File meta elements that repeat a data set element, and are de-identified the same way
+var metaCopies = map[tag.Tag]tag.Tag{
+	tag.MediaStorageSOPClassUID:    tag.SOPClassUID,
+	tag.MediaStorageSOPInstanceUID: tag.SOPInstanceUID,
+}
+
+// elementHeader is the tag, VR and length of an element, along with the bytes they were read from.
+type elementHeader struct {
+	tag    tag.Tag
+	vr     string
+	length uint32
+	raw    []byte
+}
+
+// VRs with a 4-byte length in explicit encodings
+func longVR(vr string) bool {
+	switch vr {
+	case "OB", "OD", "OF", "OL", "OV", "OW", "SQ", "SV", "UC", "UN", "UR", "UT", "UV":
+		return true
+	}
+	return false
+}
+
+func readHeader(r io.Reader, explicit bool) (*elementHeader, error) {
+	raw := make([]byte, 8)
+	_, err := io.ReadFull(r, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &elementHeader{
+		tag: tag.Tag{
+			Group:   binary.LittleEndian.Uint16(raw[0:2]),
+			Element: binary.LittleEndian.Uint16(raw[2:4]),
+		},
+		raw: raw,
+	}
+
+	// Items and delimiters never carry a VR
+	if h.tag.Group == 0xFFFE || !explicit {
+		h.length = binary.LittleEndian.Uint32(raw[4:8])
+		if h.tag.Group != 0xFFFE {
+			h.vr = "UN"
+			if info, err := tag.Find(h.tag); err == nil {
+				h.vr = info.VR
+			}
+		}
+		return h, nil
+	}
+
+	h.vr = string(raw[4:6])
+	if longVR(h.vr) {
+		ext := make([]byte, 4)
+		_, err = io.ReadFull(r, ext)
+		if err != nil {
+			return nil, err
+		}
+		h.raw = append(h.raw, ext...)
+		h.length = binary.LittleEndian.Uint32(ext)
+	} else {
+		h.length = uint32(binary.LittleEndian.Uint16(raw[6:8]))
+	}
+
+	return h, nil
+}
+
+// withLength returns the header bytes rewritten for a new value length.
+func (h *elementHeader) withLength(length int, explicit bool) ([]byte, error) {
+	raw := make([]byte, len(h.raw))
+	copy(raw, h.raw)
+
+	if explicit && !longVR(h.vr) {
+		if length > 0xFFFF {
+			return nil, errors.New("value too long for " + h.vr)
+		}
+		binary.LittleEndian.PutUint16(raw[6:8], uint16(length))
+	} else {
+		binary.LittleEndian.PutUint32(raw[len(raw)-4:], uint32(length))
+	}
+	return raw, nil
+}
+
+// copyValue copies an element's value, walking nested items when the length is undefined.
+func copyValue(w io.Writer, r io.Reader, h *elementHeader, explicit bool) error {
+	if h.length != undefinedLength {
+		_, err := io.CopyN(w, r, int64(h.length))
+		return err
+	}
+
+	// Undefined-length UN is encoded as implicit little endian
+	if h.vr == "UN" {
+		explicit = false
+	}
+
+	for {
+		item, err := readHeader(r, explicit)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(item.raw)
+		if err != nil {
+			return err
+		}
+
+		switch item.tag {
+		case sequenceDelimiterTag:
+			return nil
+
+		case itemTag:
+			if item.length != undefinedLength {
+				_, err = io.CopyN(w, r, int64(item.length))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			// Nested dataset, terminated by an item delimiter
+			for {
+				nested, err := readHeader(r, explicit)
+				if err != nil {
+					return err
+				}
+				_, err = w.Write(nested.raw)
+				if err != nil {
+					return err
+				}
+				if nested.tag == itemDelimitationTag {
+					break
+				}
+				err = copyValue(w, r, nested, explicit)
+				if err != nil {
+					return err
+				}
+			}
+
+		default:
+			return errors.New("unexpected element " + tag.DebugString(item.tag) + " in sequence")
+		}
+	}
+}
+
+func padValue(vr, value string) []byte {
+	raw := []byte(value)
+	if len(raw)%2 == 1 {
+		switch vr {
+		case "UI", "OB", "UN":
+			raw = append(raw, 0)
+		default:
+			raw = append(raw, ' ')
+		}
+	}
+	return raw
+}
+
+// Apply copies a DICOM file from r to w, de-identifying the top-level elements named in the profile.
+// The preamble is blanked. Big endian and deflated transfer syntaxes are rejected rather than passed through.
+func (p *DeidProfile) Apply(w io.Writer, in io.Reader) error {
+	r := bufio.NewReader(in)
+
+	preamble := make([]byte, 132)
+	_, err := io.ReadFull(r, preamble)
+	if err != nil {
+		return err
+	}
+	if string(preamble[128:]) != "DICM" {
+		return errors.New("Keyword 'DICM' not found in the header")
+	}
+
+	// The preamble is free-form and could hold anything; blank it
+	_, err = w.Write(append(make([]byte, 128), preamble[128:]...))
+	if err != nil {
+		return err
+	}
+
+	// File meta information is always explicit little endian. It is rewritten whole, so the UIDs it repeats from
+	// the data set match their de-identified values, and its group length is recomputed.
+	transferSyntax := ""
+	var meta bytes.Buffer
+	for {
+		group, err := r.Peek(2)
+		if err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint16(group) != 0x0002 {
+			break
+		}
+
+		h, err := readHeader(r, true)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, h.length)
+		_, err = io.ReadFull(r, value)
+		if err != nil {
+			return err
+		}
+		if h.tag == transferSyntaxTag {
+			transferSyntax = strings.TrimRight(string(value), " \x00")
+		}
+		if h.tag == metaGroupLengthTag {
+			continue
+		}
+
+		if field, ok := p.fields[metaCopies[h.tag]]; ok {
+			result, keep, err := p.apply(field, h.vr, strings.TrimRight(string(value), " \x00"))
+			if err != nil {
+				return err
+			}
+			if !keep {
+				continue
+			}
+			value = padValue(h.vr, result)
+			h.raw, err = h.withLength(len(value), true)
+			if err != nil {
+				return err
+			}
+		}
+
+		meta.Write(h.raw)
+		meta.Write(value)
+	}
+
+	var group bytes.Buffer
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(meta.Len()))
+	write_explicit(&group, metaGroupLengthTag.Element, "UL", length)
+	group.Write(meta.Bytes())
+	_, err = w.Write(group.Bytes())
+	if err != nil {
+		return err
+	}
+
+	switch transferSyntax {
+	case transferExplicitBig, transferDeflated:
+		return errors.New("Transfer syntax " + transferSyntax + " is not supported for de-identification")
+	}
+	explicit := transferSyntax != transferImplicitLittle
+
+	for {
+		h, err := readHeader(r, explicit)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		field, ok := p.fields[h.tag]
+		if ok && h.length == undefinedLength {
+			// Only sequences can be given in the profile with undefined length, and those only to remove
+			if field.action() != DeidRemove {
+				return errors.New("Cannot " + field.action() + " " + field.info.Name + ", which has undefined length")
+			}
+			err = copyValue(ioutil.Discard, r, h, explicit)
+			if err != nil {
+				return err
+			}
+			p.count(field)
+			continue
+		}
+		if !ok {
+			_, err = w.Write(h.raw)
+			if err != nil {
+				return err
+			}
+			err = copyValue(w, r, h, explicit)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		value := make([]byte, h.length)
+		_, err = io.ReadFull(r, value)
+		if err != nil {
+			return err
+		}
+
+		result, keep, err := p.apply(field, h.vr, strings.TrimRight(string(value), " \x00"))
+		if err != nil {
+			return err
+		}
+		p.count(field)
+		if !keep {
+			continue
+		}
+
+		padded := padValue(h.vr, result)
+		header, err := h.withLength(len(padded), explicit)
+		if err != nil {
+			return errors.New("Could not de-identify " + field.info.Name + ": " + err.Error())
+		}
+
+		_, err = w.Write(append(header, padded...))
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	fp "path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	tag "github.com/grailbio/go-dicom/dicomtag"
+)
+
+func load_profile(t *testing.T, yaml string) (*DeidProfile, error) {
+	path := fp.Join(t.TempDir(), "profile.yaml")
+	err := ioutil.WriteFile(path, []byte(yaml), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return LoadDeidProfile(path)
+}
+
+func must_load_profile(t *testing.T, yaml string) *DeidProfile {
+	profile, err := load_profile(t, yaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profile
+}
+
+// read_elements reads the top-level elements of an explicit little endian data set, keyed by tag.
+func read_elements(t *testing.T, data []byte) map[tag.Tag]string {
+	elements := map[tag.Tag]string{}
+	r := bytes.NewReader(data)
+	for {
+		h, err := readHeader(r, true)
+		if err == io.EOF {
+			return elements
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if h.length == undefinedLength {
+			t.Fatalf("unexpected undefined length element %v", h.tag)
+		}
+		value := make([]byte, h.length)
+		_, err = io.ReadFull(r, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		elements[h.tag] = strings.TrimRight(string(value), " \x00")
+	}
+}
+
+// deidentify writes a file with the given data set, runs it through the profile and returns the result.
+func deidentify(t *testing.T, profile *DeidProfile, sop string, data []byte) []byte {
+	var out bytes.Buffer
+	err := profile.Apply(&out, bytes.NewReader(part10(testSOPClass, sop, transferExplicitLittle, "TEST", data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestDeidRewritesFileMeta(t *testing.T) {
+	profile := must_load_profile(t, `
+dicom:
+  salt: secret
+  fields:
+    - name: SOPInstanceUID
+      hash: true
+`)
+
+	var data bytes.Buffer
+	write_element(&data, 0x0008, 0x0016, "UI", ui(testSOPClass))
+	write_element(&data, 0x0008, 0x0018, "UI", ui("1.2.3.4"))
+	raw := deidentify(t, profile, "1.2.3.4", data.Bytes())
+
+	// The group length covers exactly the file meta elements that follow it
+	end := 144 + int(binary.LittleEndian.Uint32(raw[140:144]))
+	meta := raw[144:end]
+	for len(meta) > 0 {
+		h, err := readHeader(bytes.NewReader(meta), true)
+		if err != nil || h.tag.Group != 0x0002 || len(meta) < len(h.raw)+int(h.length) {
+			t.Fatal("group length does not match the file meta information")
+		}
+		meta = meta[len(h.raw)+int(h.length):]
+	}
+	if binary.LittleEndian.Uint16(raw[end:]) == 0x0002 {
+		t.Fatal("file meta information continues past its group length")
+	}
+
+	path := fp.Join(t.TempDir(), "out.dcm")
+	err := ioutil.WriteFile(path, raw, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := read_part10(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := profile.hash("UI", "1.2.3.4")
+	sop := read_elements(t, file.data)[tag.Tag{Group: 0x0008, Element: 0x0018}]
+	if sop != want || file.sopInstance != want {
+		t.Errorf("got SOPInstanceUID %s and MediaStorageSOPInstanceUID %s, want both %s", sop, file.sopInstance, want)
+	}
+	if bytes.Contains(raw, []byte("1.2.3.4")) {
+		t.Error("the original SOPInstanceUID is still in the file")
+	}
+}
+
+func TestDeidRemovesUndefinedLengthSequence(t *testing.T) {
+	profile := must_load_profile(t, `
+dicom:
+  fields:
+    - name: ReferencedStudySequence
+      remove: true
+`)
+
+	var data bytes.Buffer
+	write_element(&data, 0x0008, 0x0018, "UI", ui("1.2.3.4"))
+	// (0008,1110) SQ of undefined length, holding one empty item
+	data.Write([]byte{0x08, 0x00, 0x10, 0x11, 'S', 'Q', 0, 0, 0xFF, 0xFF, 0xFF, 0xFF})
+	data.Write([]byte{0xFE, 0xFF, 0x00, 0xE0, 0, 0, 0, 0})
+	data.Write([]byte{0xFE, 0xFF, 0xDD, 0xE0, 0, 0, 0, 0})
+	write_element(&data, 0x0010, 0x0010, "PN", padValue("PN", "Doe^Jane"))
+
+	raw := deidentify(t, profile, "1.2.3.4", data.Bytes())
+	file := raw[132:]
+	for binary.LittleEndian.Uint16(file) == 0x0002 {
+		h, err := readHeader(bytes.NewReader(file), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file = file[len(h.raw)+int(h.length):]
+	}
+
+	elements := read_elements(t, file)
+	if _, ok := elements[tag.Tag{Group: 0x0008, Element: 0x1110}]; ok {
+		t.Error("the sequence was not removed")
+	}
+	if elements[tag.Tag{Group: 0x0010, Element: 0x0010}] != "Doe^Jane" {
+		t.Errorf("elements after the sequence were not kept: %v", elements)
+	}
+}
+
+func TestLoadDeidProfileRejects(t *testing.T) {
+	cases := map[string]string{
+		"hash without a salt": `
+dicom:
+  fields:
+    - name: PatientName
+      hash: true
+`,
+		"file meta information": `
+dicom:
+  fields:
+    - name: MediaStorageSOPInstanceUID
+      replace-with: "1.2.3"
+`,
+		"sequence not removed": `
+dicom:
+  salt: secret
+  fields:
+    - name: ReferencedStudySequence
+      hash: true
+`,
+		"hash of a binary VR": `
+dicom:
+  salt: secret
+  fields:
+    - name: Rows
+      hash: true
+`,
+		"two actions": `
+dicom:
+  fields:
+    - name: PatientName
+      remove: true
+      replace-with: x
+`,
+	}
+
+	for name, yaml := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := load_profile(t, yaml)
+			if err == nil {
+				t.Error("profile was accepted")
+			}
+		})
+	}
+}
+
+func TestDeidHashKeepsValuesValid(t *testing.T) {
+	profile := &DeidProfile{Dicom: DeidDicomProfile{Salt: "secret"}}
+
+	for _, value := range []string{"20200101", "Doe^Jane", "1.2.840.1", "042Y"} {
+		if _, err := time.Parse("20060102", profile.hash("DA", value)); err != nil {
+			t.Errorf("DA: %v", err)
+		}
+		if _, err := time.Parse("20060102150405", profile.hash("DT", value)); err != nil {
+			t.Errorf("DT: %v", err)
+		}
+		if _, err := time.Parse("150405", profile.hash("TM", value)); err != nil {
+			t.Errorf("TM: %v", err)
+		}
+
+		formats := map[string]string{
+			"AS": `^\d{3}Y$`,
+			"IS": `^\d{1,12}$`,
+			"DS": `^\d{1,16}$`,
+			"CS": `^[0-9A-F]{16}$`,
+			"UI": `^2\.25\.\d+$`,
+			"LO": `^[0-9a-f]{16}$`,
+		}
+		for vr, format := range formats {
+			if hashed := profile.hash(vr, value); !regexp.MustCompile(format).MatchString(hashed) {
+				t.Errorf("%s: hash %q does not match %s", vr, hashed, format)
+			}
+		}
+	}
+
+	if profile.hash("LO", "a") == profile.hash("LO", "b") {
+		t.Error("different values hash the same")
+	}
+}
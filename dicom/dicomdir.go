@@ -0,0 +1,104 @@
+package dicom
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	dicom "github.com/grailbio/go-dicom"
+	tag "github.com/grailbio/go-dicom/dicomtag"
+
+	. "flywheel.io/fw/util"
+)
+
+// dicomdirIndex holds the files a DICOMDIR references, as lowercase slash paths relative to its folder.
+// Media file systems are case-insensitive, so references are matched the same way.
+type dicomdirIndex map[string]bool
+
+func is_dicomdir(name string) bool {
+	return strings.EqualFold(path.Base(strings.Replace(name, "\\", "/", -1)), "DICOMDIR")
+}
+
+func parse_dicomdir(data []byte) (dicomdirIndex, error) {
+	ds, err := dicom.ReadDataSetInBytes(data, dicom.ReadOptions{DropPixelData: true})
+	if err != nil {
+		return nil, err
+	}
+
+	index := dicomdirIndex{}
+	collect_file_ids(ds.Elements, index)
+	return index, nil
+}
+
+// find_dicomdir loads the DICOMDIR directly inside a folder, if it has one.
+func find_dicomdir(folder string) (dicomdirIndex, error) {
+	entries, err := ioutil.ReadDir(folder)
+	if err != nil {
+		// The walk reports unreadable folders itself
+		return nil, nil
+	}
+
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && is_dicomdir(entry.Name()) {
+			data, err := ioutil.ReadFile(filepath.Join(folder, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			return parse_dicomdir(data)
+		}
+	}
+	return nil, nil
+}
+
+// collect_file_ids finds every ReferencedFileID, descending into the directory record sequence.
+func collect_file_ids(elements []*dicom.Element, index dicomdirIndex) {
+	for _, el := range elements {
+		if el.Tag == tag.ReferencedFileID {
+			parts, err := el.GetStrings()
+			if err == nil && len(parts) > 0 {
+				index[strings.ToLower(strings.Join(parts, "/"))] = true
+			}
+			continue
+		}
+
+		var children []*dicom.Element
+		for _, x := range el.Value {
+			if child, ok := x.(*dicom.Element); ok {
+				children = append(children, child)
+			}
+		}
+		collect_file_ids(children, index)
+	}
+}
+
+// listed reports whether a slash path is referenced by the DICOMDIR of the nearest folder that has one.
+// Files under no DICOMDIR are always listed.
+func listed(indexes map[string]dicomdirIndex, name string) bool {
+	name = strings.Replace(name, "\\", "/", -1)
+
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if index, ok := indexes[dir]; ok {
+			rel := strings.TrimPrefix(name, dir+"/")
+			if dir == "." {
+				rel = name
+			}
+			return index[strings.ToLower(rel)]
+		}
+		if dir == "." || dir == "/" {
+			return true
+		}
+	}
+}
+
+// skip_unlisted records a file that a DICOMDIR does not reference.
+func skip_unlisted(name string) {
+	atomic.AddInt64(&files_skipped, 1)
+	importReport.AddFile(&ReportFile{
+		Name:   path.Base(name),
+		Path:   name,
+		Status: FileSkipped,
+		Error:  "not listed in DICOMDIR",
+	})
+}
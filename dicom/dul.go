@@ -0,0 +1,568 @@
+package dicom
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	tag "github.com/grailbio/go-dicom/dicomtag"
+)
+
+// A minimal DICOM upper layer (PS3.8) and DIMSE (PS3.7) implementation: enough to receive and send C-STORE and C-ECHO.
+
+// PDU types
+const (
+	pduAssociateRQ = 0x01
+	pduAssociateAC = 0x02
+	pduAssociateRJ = 0x03
+	pduData        = 0x04
+	pduReleaseRQ   = 0x05
+	pduReleaseRP   = 0x06
+	pduAbort       = 0x07
+)
+
+// Association items
+const (
+	itemApplicationContext = 0x10
+	itemContextRQ          = 0x20
+	itemContextAC          = 0x21
+	itemAbstractSyntax     = 0x30
+	itemTransferSyntax     = 0x40
+	itemUserInfo           = 0x50
+	itemMaxLength          = 0x51
+	itemImplementationUID  = 0x52
+	itemImplementationName = 0x55
+)
+
+// DIMSE command fields
+const (
+	commandStoreRQ  = 0x0001
+	commandStoreRSP = 0x8001
+	commandEchoRQ   = 0x0030
+	commandEchoRSP  = 0x8030
+)
+
+// DIMSE command set elements, all in group 0000
+const (
+	elementGroupLength            = 0x0000
+	elementAffectedSOPClassUID    = 0x0002
+	elementCommandField           = 0x0100
+	elementMessageID              = 0x0110
+	elementMessageIDRespondedTo   = 0x0120
+	elementPriority               = 0x0700
+	elementCommandDataSetType     = 0x0800
+	elementStatus                 = 0x0900
+	elementAffectedSOPInstanceUID = 0x1000
+)
+
+const (
+	// CommandDataSetType value meaning no data set follows
+	noDataSet = 0x0101
+
+	statusSuccess          = 0x0000
+	statusOutOfResources   = 0xA700
+	statusCannotUnderstand = 0xC000
+
+	applicationContextUID  = "1.2.840.10008.3.1.1.1"
+	verificationUID        = "1.2.840.10008.1.1"
+	transferExplicitLittle = "1.2.840.10008.1.2.1"
+
+	implementationUID  = "2.25.333517762400366492982975068314537257584"
+	implementationName = "FW_CLI"
+
+	// Largest PDU this end accepts
+	maxPDULength = 1 << 20
+
+	// Largest command and data set reassembled from P-DATA, so a peer cannot exhaust memory
+	maxCommandLength = 1 << 16
+	maxDataSetLength = 1 << 30
+
+	// How long an association may sit idle before it is dropped
+	associationTimeout = 5 * time.Minute
+)
+
+// presentationContext is one abstract syntax and the transfer syntaxes proposed, or the one accepted, for it.
+type presentationContext struct {
+	id               byte
+	abstractSyntax   string
+	transferSyntaxes []string
+
+	// 0 for acceptance; only meaningful in an A-ASSOCIATE-AC
+	result byte
+}
+
+// associateParams are the fields shared by A-ASSOCIATE-RQ and A-ASSOCIATE-AC.
+type associateParams struct {
+	calledAE  string
+	callingAE string
+	contexts  []*presentationContext
+	maxLength uint32
+}
+
+func read_pdu(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 6)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[2:6])
+	if length > maxPDULength+1024 {
+		return 0, nil, fmt.Errorf("PDU of %d bytes exceeds the negotiated maximum", length)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	return header[0], data, err
+}
+
+func write_pdu(w io.Writer, kind byte, data []byte) error {
+	header := make([]byte, 6)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[2:6], uint32(len(data)))
+	_, err := w.Write(append(header, data...))
+	return err
+}
+
+// item encodes an association item or sub-item, which carry a 2-byte length.
+func item(kind byte, data []byte) []byte {
+	header := []byte{kind, 0, 0, 0}
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(data)))
+	return append(header, data...)
+}
+
+func ae_title(title string) []byte {
+	return []byte(fmt.Sprintf("%-16.16s", title))
+}
+
+// encode_associate builds the body of an A-ASSOCIATE-RQ or -AC.
+func encode_associate(kind byte, params *associateParams) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0, 1, 0, 0})
+	b.Write(ae_title(params.calledAE))
+	b.Write(ae_title(params.callingAE))
+	b.Write(make([]byte, 32))
+
+	b.Write(item(itemApplicationContext, []byte(applicationContextUID)))
+
+	for _, pc := range params.contexts {
+		var sub bytes.Buffer
+		if kind == pduAssociateRQ {
+			sub.Write([]byte{pc.id, 0, 0, 0})
+			sub.Write(item(itemAbstractSyntax, []byte(pc.abstractSyntax)))
+			for _, ts := range pc.transferSyntaxes {
+				sub.Write(item(itemTransferSyntax, []byte(ts)))
+			}
+			b.Write(item(itemContextRQ, sub.Bytes()))
+		} else {
+			sub.Write([]byte{pc.id, 0, pc.result, 0})
+			if len(pc.transferSyntaxes) > 0 {
+				sub.Write(item(itemTransferSyntax, []byte(pc.transferSyntaxes[0])))
+			}
+			b.Write(item(itemContextAC, sub.Bytes()))
+		}
+	}
+
+	maxLength := make([]byte, 4)
+	binary.BigEndian.PutUint32(maxLength, maxPDULength)
+
+	var user bytes.Buffer
+	user.Write(item(itemMaxLength, maxLength))
+	user.Write(item(itemImplementationUID, []byte(implementationUID)))
+	user.Write(item(itemImplementationName, []byte(implementationName)))
+	b.Write(item(itemUserInfo, user.Bytes()))
+
+	return b.Bytes()
+}
+
+// parse_items splits a run of association items into their types and values.
+func parse_items(data []byte, fn func(kind byte, value []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return errors.New("truncated association item")
+		}
+		kind := data[0]
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+length {
+			return errors.New("truncated association item")
+		}
+		err := fn(kind, data[4:4+length])
+		if err != nil {
+			return err
+		}
+		data = data[4+length:]
+	}
+	return nil
+}
+
+func parse_associate(data []byte) (*associateParams, error) {
+	if len(data) < 68 {
+		return nil, errors.New("truncated association request")
+	}
+
+	params := &associateParams{
+		calledAE:  strings.TrimSpace(string(data[4:20])),
+		callingAE: strings.TrimSpace(string(data[20:36])),
+	}
+
+	err := parse_items(data[68:], func(kind byte, value []byte) error {
+		switch kind {
+		case itemContextRQ, itemContextAC:
+			if len(value) < 4 {
+				return errors.New("truncated presentation context")
+			}
+			pc := &presentationContext{id: value[0], result: value[2]}
+			err := parse_items(value[4:], func(kind byte, value []byte) error {
+				uid := strings.TrimRight(string(value), " \x00")
+				switch kind {
+				case itemAbstractSyntax:
+					pc.abstractSyntax = uid
+				case itemTransferSyntax:
+					pc.transferSyntaxes = append(pc.transferSyntaxes, uid)
+				}
+				return nil
+			})
+			params.contexts = append(params.contexts, pc)
+			return err
+
+		case itemUserInfo:
+			return parse_items(value, func(kind byte, value []byte) error {
+				if kind == itemMaxLength && len(value) == 4 {
+					params.maxLength = binary.BigEndian.Uint32(value)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	return params, err
+}
+
+// commandSet is a DIMSE command, keyed by element number within group 0000.
+type commandSet map[uint16][]byte
+
+func us(value uint16) []byte {
+	raw := make([]byte, 2)
+	binary.LittleEndian.PutUint16(raw, value)
+	return raw
+}
+
+func ui(value string) []byte {
+	return padValue("UI", value)
+}
+
+// encode_command writes a command set in implicit VR little endian, led by its group length.
+func encode_command(c commandSet) []byte {
+	var elements []int
+	for el := range c {
+		if el != elementGroupLength {
+			elements = append(elements, int(el))
+		}
+	}
+	sort.Ints(elements)
+
+	var body bytes.Buffer
+	for _, el := range elements {
+		write_implicit(&body, uint16(el), c[uint16(el)])
+	}
+
+	var b bytes.Buffer
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(body.Len()))
+	write_implicit(&b, elementGroupLength, length)
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+func write_implicit(w *bytes.Buffer, element uint16, value []byte) {
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint16(header[2:4], element)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(value)))
+	w.Write(header)
+	w.Write(value)
+}
+
+func parse_command(data []byte) (commandSet, error) {
+	c := commandSet{}
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("truncated command set")
+		}
+		group := binary.LittleEndian.Uint16(data[0:2])
+		element := binary.LittleEndian.Uint16(data[2:4])
+		length := int(binary.LittleEndian.Uint32(data[4:8]))
+		if group != 0 || len(data) < 8+length {
+			return nil, errors.New("malformed command set")
+		}
+		c[element] = data[8 : 8+length]
+		data = data[8+length:]
+	}
+	return c, nil
+}
+
+func (c commandSet) uint16(element uint16) uint16 {
+	value := c[element]
+	if len(value) < 2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(value)
+}
+
+func (c commandSet) string(element uint16) string {
+	return strings.TrimRight(string(c[element]), " \x00")
+}
+
+// dimseMessage is a command and its optional data set, reassembled from P-DATA fragments.
+type dimseMessage struct {
+	context byte
+	command commandSet
+	data    []byte
+}
+
+var errReleased = errors.New("association released")
+var errAborted = errors.New("association aborted")
+
+// dulConn carries DIMSE messages over an established association.
+type dulConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// Largest PDU the peer accepts; 0 means no limit
+	maxSend uint32
+
+	// Largest data set accepted from the peer
+	maxData int
+}
+
+func new_dul_conn(conn net.Conn) *dulConn {
+	return &dulConn{conn: conn, r: bufio.NewReader(conn), maxData: maxDataSetLength}
+}
+
+func (d *dulConn) read_pdu() (byte, []byte, error) {
+	d.conn.SetReadDeadline(time.Now().Add(associationTimeout))
+	return read_pdu(d.r)
+}
+
+// next_message reads P-DATA PDUs until a whole message has arrived.
+// A release request from the peer is answered and reported as errReleased.
+func (d *dulConn) next_message() (*dimseMessage, error) {
+	msg := &dimseMessage{}
+	var command, data bytes.Buffer
+	commandDone := false
+
+	for {
+		kind, pdu, err := d.read_pdu()
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case pduData:
+		case pduReleaseRQ:
+			write_pdu(d.conn, pduReleaseRP, make([]byte, 4))
+			return nil, errReleased
+		case pduAbort:
+			return nil, errAborted
+		default:
+			return nil, fmt.Errorf("unexpected PDU type %d", kind)
+		}
+
+		for len(pdu) > 0 {
+			if len(pdu) < 6 {
+				return nil, errors.New("truncated PDV item")
+			}
+			length := int(binary.BigEndian.Uint32(pdu[0:4]))
+			if length < 2 || len(pdu) < 4+length {
+				return nil, errors.New("truncated PDV item")
+			}
+			msg.context = pdu[4]
+			control := pdu[5]
+			fragment := pdu[6 : 4+length]
+			pdu = pdu[4+length:]
+
+			if control&0x01 != 0 {
+				if command.Len()+len(fragment) > maxCommandLength {
+					return nil, fmt.Errorf("command larger than %d bytes", maxCommandLength)
+				}
+				command.Write(fragment)
+				if control&0x02 == 0 {
+					continue
+				}
+
+				msg.command, err = parse_command(command.Bytes())
+				if err != nil {
+					return nil, err
+				}
+				commandDone = true
+				if msg.command.uint16(elementCommandDataSetType) == noDataSet {
+					return msg, nil
+				}
+			} else {
+				if !commandDone {
+					return nil, errors.New("data set received before its command")
+				}
+				if data.Len()+len(fragment) > d.maxData {
+					return nil, fmt.Errorf("data set larger than %d bytes", d.maxData)
+				}
+				data.Write(fragment)
+				if control&0x02 != 0 {
+					msg.data = data.Bytes()
+					return msg, nil
+				}
+			}
+		}
+	}
+}
+
+// send_message writes a command and optional data set, fragmented to fit the peer's maximum PDU length.
+func (d *dulConn) send_message(context byte, command commandSet, data []byte) error {
+	err := d.send_fragments(context, 0x01, encode_command(command))
+	if err != nil || data == nil {
+		return err
+	}
+	return d.send_fragments(context, 0x00, data)
+}
+
+func (d *dulConn) send_fragments(context byte, control byte, data []byte) error {
+	size := len(data)
+	if d.maxSend > 6 && int(d.maxSend-6) < size {
+		size = int(d.maxSend - 6)
+	}
+	if size == 0 {
+		size = 1
+	}
+
+	for {
+		fragment := data
+		last := true
+		if len(fragment) > size {
+			fragment, last = data[:size], false
+		}
+		data = data[len(fragment):]
+
+		mch := control
+		if last {
+			mch |= 0x02
+		}
+
+		pdv := make([]byte, 6, 6+len(fragment))
+		binary.BigEndian.PutUint32(pdv[0:4], uint32(2+len(fragment)))
+		pdv[4] = context
+		pdv[5] = mch
+		pdv = append(pdv, fragment...)
+
+		err := write_pdu(d.conn, pduData, pdv)
+		if err != nil || last {
+			return err
+		}
+	}
+}
+
+// part10 wraps a received data set in a DICOM file: preamble, DICM prefix and file meta information.
+func part10(sopClass, sopInstance, transferSyntax, sourceAE string, data []byte) []byte {
+	var meta bytes.Buffer
+	write_explicit(&meta, 0x0001, "OB", []byte{0, 1})
+	write_explicit(&meta, 0x0002, "UI", ui(sopClass))
+	write_explicit(&meta, 0x0003, "UI", ui(sopInstance))
+	write_explicit(&meta, 0x0010, "UI", ui(transferSyntax))
+	write_explicit(&meta, 0x0012, "UI", ui(implementationUID))
+	write_explicit(&meta, 0x0013, "SH", padValue("SH", implementationName))
+	if sourceAE != "" {
+		write_explicit(&meta, 0x0016, "AE", padValue("AE", sourceAE))
+	}
+
+	var b bytes.Buffer
+	b.Write(make([]byte, 128))
+	b.WriteString("DICM")
+
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(meta.Len()))
+	write_explicit(&b, 0x0000, "UL", length)
+	b.Write(meta.Bytes())
+	b.Write(data)
+	return b.Bytes()
+}
+
+// write_explicit writes a file meta element in explicit VR little endian.
+func write_explicit(w *bytes.Buffer, element uint16, vr string, value []byte) {
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint16(header[0:2], 0x0002)
+	binary.LittleEndian.PutUint16(header[2:4], element)
+	w.Write(header)
+	w.WriteString(vr)
+
+	if longVR(vr) {
+		length := make([]byte, 6)
+		binary.LittleEndian.PutUint32(length[2:6], uint32(len(value)))
+		w.Write(length)
+	} else {
+		length := make([]byte, 2)
+		binary.LittleEndian.PutUint16(length, uint16(len(value)))
+		w.Write(length)
+	}
+	w.Write(value)
+}
+
+// part10File is a DICOM file split into what C-STORE needs: its identifiers and the data set after the meta group.
+type part10File struct {
+	sopClass       string
+	sopInstance    string
+	transferSyntax string
+	data           []byte
+}
+
+func read_part10(path string) (*part10File, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 132 || string(raw[128:132]) != "DICM" {
+		return nil, errors.New("Keyword 'DICM' not found in the header")
+	}
+
+	file := &part10File{}
+	r := bytes.NewReader(raw[132:])
+
+	for r.Len() >= 2 {
+		offset := len(raw) - r.Len()
+		if binary.LittleEndian.Uint16(raw[offset:offset+2]) != 0x0002 {
+			break
+		}
+
+		h, err := readHeader(r, true)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, h.length)
+		_, err = io.ReadFull(r, value)
+		if err != nil {
+			return nil, err
+		}
+
+		uid := strings.TrimRight(string(value), " \x00")
+		switch h.tag {
+		case tag.MediaStorageSOPClassUID:
+			file.sopClass = uid
+		case tag.MediaStorageSOPInstanceUID:
+			file.sopInstance = uid
+		case transferSyntaxTag:
+			file.transferSyntax = uid
+		}
+	}
+
+	if file.sopClass == "" || file.sopInstance == "" || file.transferSyntax == "" {
+		return nil, errors.New("file meta information is missing the SOP class, instance or transfer syntax")
+	}
+
+	file.data = raw[len(raw)-r.Len():]
+	return file, nil
+}
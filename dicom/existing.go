@@ -0,0 +1,260 @@
+package dicom
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"flywheel.io/sdk/api"
+
+	"flywheel.io/fw/legacy"
+)
+
+// Policies for series that were already uploaded to the project.
+const (
+	// Leave existing series alone
+	ExistingSkip = "skip"
+
+	// Upload only the SOP instances the server does not have yet
+	ExistingAppend = "append"
+
+	// Upload the whole series again, replacing the existing file
+	ExistingReplace = "replace"
+)
+
+var existingPolicy = ExistingSkip
+
+// ExistingSeries is what the server already holds for an acquisition with the same uid.
+type ExistingSeries struct {
+	Id        string
+	Files     []string
+	Instances int
+
+	// SOPInstanceUIDs found in the existing zips; nil if they could not be listed
+	Sops map[string]bool
+}
+
+type remoteFile struct {
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	ZipMemberCount int    `json:"zip_member_count"`
+}
+
+type remoteContainer struct {
+	Id    string        `json:"_id"`
+	Uid   string        `json:"uid"`
+	Label string        `json:"label"`
+	Files []*remoteFile `json:"files"`
+}
+
+type zipInfo struct {
+	Members []struct {
+		Path string `json:"path"`
+	} `json:"members"`
+}
+
+func setExistingPolicy(policy string) error {
+	switch policy {
+	case "":
+		existingPolicy = ExistingSkip
+	case ExistingSkip, ExistingAppend, ExistingReplace:
+		existingPolicy = policy
+	default:
+		return errors.New("Unknown existing policy " + policy + "; use " + ExistingSkip + ", " + ExistingAppend + " or " + ExistingReplace)
+	}
+	return nil
+}
+
+// normalize_uid matches uids whether or not they were stored with dots.
+func normalize_uid(uid string) string {
+	return strings.Replace(uid, ".", "", -1)
+}
+
+func get_containers(client *api.Client, url string) ([]*remoteContainer, error) {
+	var aerr *api.Error
+	var result []*remoteContainer
+
+	_, err := client.New().Get(url).Receive(&result, &aerr)
+	if err != nil {
+		return nil, err
+	} else if aerr != nil {
+		return nil, errors.New(aerr.Message)
+	}
+	return result, nil
+}
+
+// find_existing marks the sessions and acquisitions that the target project already has, matched by uid.
+func find_existing(client *api.Client, group_id string, project_label string, sessions map[string]Session) error {
+	result, _, err, aerr := legacy.ResolvePath(client, []string{group_id, project_label})
+	if err != nil {
+		return err
+	} else if aerr != nil || result == nil || len(result.Path) < 2 {
+		// The project does not exist yet, so neither does anything in it
+		return nil
+	}
+
+	project, ok := result.Path[len(result.Path)-1].(*legacy.Project)
+	if !ok {
+		return nil
+	}
+
+	remote_sessions, err := get_containers(client, "projects/"+project.Id+"/sessions")
+	if err != nil {
+		return err
+	}
+
+	for _, remote_session := range remote_sessions {
+		session, ok := sessions[normalize_uid(remote_session.Uid)]
+		if !ok || remote_session.Uid == "" {
+			continue
+		}
+		session.ExistingId = remote_session.Id
+		sessions[normalize_uid(remote_session.Uid)] = session
+
+		remote_acquisitions, err := get_containers(client, "sessions/"+remote_session.Id+"/acquisitions")
+		if err != nil {
+			return err
+		}
+
+		for _, remote_acq := range remote_acquisitions {
+			acq, ok := session.Acquisitions[normalize_uid(remote_acq.Uid)]
+			if !ok || remote_acq.Uid == "" {
+				continue
+			}
+			// An acquisition without DICOM files is left over from a failed upload, so it is uploaded again
+			series := existing_series(client, remote_acq)
+			if len(series.Files) > 0 {
+				acq.Existing = series
+			}
+		}
+	}
+
+	return nil
+}
+
+// existing_series counts the instances in an acquisition's DICOM zips, listing their members when appending.
+func existing_series(client *api.Client, remote_acq *remoteContainer) *ExistingSeries {
+	series := &ExistingSeries{Id: remote_acq.Id}
+
+	for _, file := range remote_acq.Files {
+		if file.Type != "dicom" && !strings.HasSuffix(file.Name, ".dcm.zip") {
+			continue
+		}
+		series.Files = append(series.Files, file.Name)
+		series.Instances += file.ZipMemberCount
+	}
+
+	if existingPolicy != ExistingAppend {
+		return series
+	}
+
+	series.Sops = map[string]bool{}
+	for _, name := range series.Files {
+		var aerr *api.Error
+		var info zipInfo
+
+		_, err := client.New().Get("acquisitions/"+remote_acq.Id+"/files/"+url.PathEscape(name)).Set("Accept", "application/json").QueryStruct(&struct {
+			Info bool `url:"info"`
+		}{true}).Receive(&info, &aerr)
+
+		if err != nil || aerr != nil {
+			series.Sops = nil
+			return series
+		}
+
+		for _, member := range info.Members {
+			sop := member_sop(member.Path)
+			if sop == "" {
+				// Members not named by SOPInstanceUID cannot be compared
+				series.Sops = nil
+				return series
+			}
+			series.Sops[sop] = true
+		}
+	}
+
+	return series
+}
+
+// member_sop recovers the SOPInstanceUID from a zip member named {Modality}.{SOPInstanceUID}.dcm or
+// {SOPInstanceUID}.dcm. Members named any other way, such as by InstanceNumber, give an empty string.
+func member_sop(name string) string {
+	name = strings.TrimSuffix(path.Base(name), ".dcm")
+	if !is_uid(name) {
+		i := strings.Index(name, ".")
+		if i < 0 {
+			return ""
+		}
+		name = name[i+1:]
+	}
+	if !is_uid(name) {
+		return ""
+	}
+	return name
+}
+
+// is_uid reports whether s looks like a DICOM UID: digits separated by dots.
+func is_uid(s string) bool {
+	if !strings.Contains(s, ".") {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// new_instances returns the files of an existing acquisition that the server does not have.
+// Returns nil when the server's zip members cannot be matched to SOP Instance UIDs, as with the instance-number
+// or path naming, since there is then no telling which instances are new.
+func new_instances(acq *Acquisition) map[string]DicomFile {
+	existing := acq.Existing
+	if existing.Sops == nil {
+		return nil
+	}
+
+	result := map[string]DicomFile{}
+
+	for sop, file := range acq.Files {
+		if !existing.Sops[sop] {
+			result[sop] = file
+		}
+	}
+	return result
+}
+
+// existing_note describes an existing acquisition and what will happen to it, for the tree preview.
+func existing_note(acq *Acquisition) string {
+	existing := acq.Existing
+	note := fmt.Sprintf("(existing: %d local / %d on server", len(acq.Files), existing.Instances)
+
+	switch existingPolicy {
+	case ExistingSkip:
+		note += ", skip)"
+	case ExistingReplace:
+		note += ", replace)"
+	case ExistingAppend:
+		if files := new_instances(acq); files == nil {
+			note += ", cannot append: server instances unknown)"
+		} else {
+			note += fmt.Sprintf(", append %d new)", len(files))
+		}
+	}
+	return note
+}
+
+func count_existing(sessions map[string]Session) int {
+	count := 0
+	for _, session := range sessions {
+		for _, acq := range session.Acquisitions {
+			if acq.Existing != nil {
+				count++
+			}
+		}
+	}
+	return count
+}
@@ -0,0 +1,306 @@
+package dicom
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	dicom "github.com/grailbio/go-dicom"
+	tag "github.com/grailbio/go-dicom/dicomtag"
+
+	. "flywheel.io/fw/util"
+)
+
+// InspectOptions configures a header dump.
+type InspectOptions struct {
+	// Tags to show, by keyword or hex; all tags when empty
+	Tags []string
+
+	// Tags to summarize files by, instead of listing each file
+	GroupBy []string
+
+	Json bool
+}
+
+// InspectElement is one header element, as printed by Inspect.
+type InspectElement struct {
+	Tag   string `json:"tag"`
+	VR    string `json:"vr"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type InspectFile struct {
+	Path     string            `json:"path"`
+	Elements []*InspectElement `json:"elements"`
+}
+
+// InspectGroup summarizes the files sharing the same values of the group-by tags.
+type InspectGroup struct {
+	Group  map[string]string   `json:"group"`
+	Files  int                 `json:"files"`
+	Values map[string][]string `json:"values,omitempty"`
+
+	key []string
+}
+
+// Inspect prints the DICOM headers of a file, or of every file in a folder or archive.
+func Inspect(path string, options *InspectOptions) {
+	importReport = NewImportReport()
+	defer close_archives()
+
+	tags, err := find_tags(options.Tags)
+	Check(err)
+	groupBy, err := find_tags(options.GroupBy)
+	Check(err)
+
+	readOptions := dicom.ReadOptions{DropPixelData: true}
+	if len(tags) > 0 || len(groupBy) > 0 {
+		for _, info := range append(groupBy, tags...) {
+			readOptions.ReturnTags = append(readOptions.ReturnTags, info.Tag)
+		}
+	}
+
+	paths := make(chan walkedFile)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- walkFiles(path, paths)
+	}()
+
+	var files []*InspectFile
+	groups := map[string]*InspectGroup{}
+	skipped := 0
+
+	for x := range paths {
+		file, err := read_walked(x, readOptions)
+		if err != nil {
+			if kind, _ := classify_other(x); kind != "" {
+				skipped++
+			} else {
+				Println(x.path+":", err)
+			}
+			continue
+		}
+
+		if len(groupBy) > 0 {
+			add_to_group(groups, file, groupBy, tags)
+		} else {
+			files = append(files, inspect_file(file, tags))
+		}
+	}
+	Check(<-errc)
+
+	if len(groupBy) > 0 {
+		print_groups(groups, groupBy, tags, options.Json)
+	} else {
+		print_files(files, tags, options.Json)
+	}
+
+	if skipped > 0 {
+		Println("Skipped", skipped, "files that are not DICOM")
+	}
+}
+
+func find_tags(names []string) ([]tag.TagInfo, error) {
+	var result []tag.TagInfo
+	for _, name := range names {
+		for _, x := range strings.Split(name, ",") {
+			x = strings.TrimSpace(x)
+			if x == "" {
+				continue
+			}
+			info, err := findTag(x)
+			if err != nil {
+				return nil, fmt.Errorf("Unknown DICOM tag %s", x)
+			}
+			result = append(result, info)
+		}
+	}
+	return result, nil
+}
+
+// element_string renders an element's value for display; binary values and sequences are only described.
+func element_string(el *dicom.Element) string {
+	var values []string
+	for _, x := range el.Value {
+		switch v := x.(type) {
+		case string:
+			values = append(values, strings.TrimSpace(v))
+		case []byte:
+			values = append(values, fmt.Sprintf("<%d bytes>", len(v)))
+		case *dicom.Element:
+			return fmt.Sprintf("<sequence of %d items>", len(el.Value))
+		default:
+			values = append(values, fmt.Sprint(v))
+		}
+	}
+	return strings.Join(values, "\\")
+}
+
+func tag_string(t tag.Tag) string {
+	return fmt.Sprintf("(%04X,%04X)", t.Group, t.Element)
+}
+
+func tag_name(t tag.Tag) string {
+	info, err := tag.Find(t)
+	if err != nil {
+		return "Unknown"
+	}
+	return info.Name
+}
+
+func find_value(file DicomFile, info tag.TagInfo) string {
+	el, err := file.FindElementByTag(info.Tag)
+	if err != nil || el == nil {
+		return ""
+	}
+	return element_string(el)
+}
+
+// inspect_file lists the requested tags of a file in the order asked for, or every element in file order.
+func inspect_file(file DicomFile, tags []tag.TagInfo) *InspectFile {
+	result := &InspectFile{Path: file.Path, Elements: []*InspectElement{}}
+
+	if len(tags) == 0 {
+		for _, el := range file.Elements {
+			result.Elements = append(result.Elements, &InspectElement{
+				Tag:   tag_string(el.Tag),
+				VR:    el.VR,
+				Name:  tag_name(el.Tag),
+				Value: element_string(el),
+			})
+		}
+		return result
+	}
+
+	for _, info := range tags {
+		x := &InspectElement{Tag: tag_string(info.Tag), VR: info.VR, Name: info.Name}
+		if el, err := file.FindElementByTag(info.Tag); err == nil && el != nil {
+			x.VR = el.VR
+			x.Value = element_string(el)
+		}
+		result.Elements = append(result.Elements, x)
+	}
+	return result
+}
+
+func add_to_group(groups map[string]*InspectGroup, file DicomFile, groupBy []tag.TagInfo, tags []tag.TagInfo) {
+	var key []string
+	for _, info := range groupBy {
+		key = append(key, find_value(file, info))
+	}
+	id := strings.Join(key, "\x00")
+
+	group, ok := groups[id]
+	if !ok {
+		group = &InspectGroup{Group: map[string]string{}, Values: map[string][]string{}, key: key}
+		for i, info := range groupBy {
+			group.Group[info.Name] = key[i]
+		}
+		groups[id] = group
+	}
+	group.Files++
+
+	for _, info := range tags {
+		value := find_value(file, info)
+		if !contains(group.Values[info.Name], value) {
+			group.Values[info.Name] = append(group.Values[info.Name], value)
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, x := range values {
+		if x == value {
+			return true
+		}
+	}
+	return false
+}
+
+// print_files prints one table per file, or a single table with a column per tag when tags were chosen.
+func print_files(files []*InspectFile, tags []tag.TagInfo, asJson bool) {
+	if asJson {
+		if files == nil {
+			files = []*InspectFile{}
+		}
+		os.Stdout.Write(FormatBytes(files))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 2, 1, ' ', 0)
+	defer w.Flush()
+
+	if len(tags) > 0 && len(files) > 1 {
+		fmt.Fprint(w, "Path")
+		for _, info := range tags {
+			fmt.Fprint(w, "\t"+info.Name)
+		}
+		fmt.Fprintln(w)
+
+		for _, file := range files {
+			fmt.Fprint(w, file.Path)
+			for _, x := range file.Elements {
+				fmt.Fprint(w, "\t"+x.Value)
+			}
+			fmt.Fprintln(w)
+		}
+		return
+	}
+
+	for i, file := range files {
+		if len(files) > 1 {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintln(w, file.Path)
+		}
+		for _, x := range file.Elements {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", x.Tag, x.VR, x.Name, x.Value)
+		}
+	}
+}
+
+// print_groups prints a row per group with its file count and the distinct values of the chosen tags.
+func print_groups(groups map[string]*InspectGroup, groupBy []tag.TagInfo, tags []tag.TagInfo, asJson bool) {
+	var sorted []*InspectGroup
+	for _, group := range groups {
+		sorted = append(sorted, group)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.Join(sorted[i].key, "\x00") < strings.Join(sorted[j].key, "\x00")
+	})
+
+	if asJson {
+		if sorted == nil {
+			sorted = []*InspectGroup{}
+		}
+		os.Stdout.Write(FormatBytes(sorted))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 2, 1, ' ', 0)
+	defer w.Flush()
+
+	for _, info := range groupBy {
+		fmt.Fprint(w, info.Name+"\t")
+	}
+	fmt.Fprint(w, "Files")
+	for _, info := range tags {
+		fmt.Fprint(w, "\t"+info.Name)
+	}
+	fmt.Fprintln(w)
+
+	for _, group := range sorted {
+		for _, value := range group.key {
+			fmt.Fprint(w, value+"\t")
+		}
+		fmt.Fprint(w, group.Files)
+		for _, info := range tags {
+			fmt.Fprint(w, "\t"+strings.Join(group.Values[info.Name], ", "))
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,291 @@
+package dicom
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	tag "github.com/grailbio/go-dicom/dicomtag"
+)
+
+// labelTemplate builds a container label from DICOM tags, such as "{StudyDate|date}_{StudyDescription}".
+//
+// Each placeholder names a tag by keyword or hex, e.g. {PatientName} or {(0010,0010)}, optionally followed by
+// formatting functions separated by |:
+//
+//	date[:layout]   reformat a DA value; layout is written as the reference date 2006-01-02, the default
+//	time[:layout]   reformat a TM value; layout is written as the reference time 15:04:05, the default
+//	upper, lower    change case
+//	default:text    use text when the tag is missing or empty
+type labelTemplate struct {
+	source string
+	parts  []*labelPart
+}
+
+type labelPart struct {
+	// Literal text between placeholders; empty for a placeholder
+	literal string
+
+	info  *tag.TagInfo
+	funcs []labelFunc
+}
+
+type labelFunc struct {
+	name string
+	arg  string
+}
+
+// Templates set for this scan; nil means the built-in naming is used
+var sessionTemplate, acquisitionTemplate, subjectTemplate *labelTemplate
+
+func setLabelTemplates(session, acquisition, subject string) error {
+	var err error
+	if sessionTemplate, err = parseLabelTemplate(session); err != nil {
+		return err
+	}
+	if acquisitionTemplate, err = parseLabelTemplate(acquisition); err != nil {
+		return err
+	}
+	if subjectTemplate, err = parseLabelTemplate(subject); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseLabelTemplate(source string) (*labelTemplate, error) {
+	if source == "" {
+		return nil, nil
+	}
+
+	t := &labelTemplate{source: source}
+	rest := source
+
+	for rest != "" {
+		i := strings.Index(rest, "{")
+		if i < 0 {
+			t.parts = append(t.parts, &labelPart{literal: rest})
+			break
+		}
+		if i > 0 {
+			t.parts = append(t.parts, &labelPart{literal: rest[:i]})
+		}
+
+		j := strings.Index(rest[i:], "}")
+		if j < 0 {
+			return nil, errors.New("Unclosed placeholder in label template " + source)
+		}
+
+		part, err := parseLabelPlaceholder(rest[i+1 : i+j])
+		if err != nil {
+			return nil, errors.New(err.Error() + " in label template " + source)
+		}
+		t.parts = append(t.parts, part)
+		rest = rest[i+j+1:]
+	}
+
+	if len(t.tags()) == 0 {
+		return nil, errors.New("Label template " + source + " does not reference any DICOM tags")
+	}
+	return t, nil
+}
+
+func parseLabelPlaceholder(placeholder string) (*labelPart, error) {
+	fields := strings.Split(placeholder, "|")
+
+	info, err := findTag(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return nil, errors.New("Unknown DICOM tag " + fields[0])
+	}
+	part := &labelPart{info: &info}
+
+	for _, x := range fields[1:] {
+		f := labelFunc{name: strings.TrimSpace(x)}
+		if k := strings.Index(x, ":"); k >= 0 {
+			f = labelFunc{name: strings.TrimSpace(x[:k]), arg: x[k+1:]}
+		}
+
+		switch f.name {
+		case "date", "time", "upper", "lower", "default":
+		default:
+			return nil, errors.New("Unknown function " + f.name + " for {" + placeholder + "}")
+		}
+		part.funcs = append(part.funcs, f)
+	}
+
+	return part, nil
+}
+
+// tags lists the tags a template reads, so the header parser can return them.
+func (t *labelTemplate) tags() []tag.Tag {
+	if t == nil {
+		return nil
+	}
+
+	var result []tag.Tag
+	for _, part := range t.parts {
+		if part.info != nil {
+			result = append(result, part.info.Tag)
+		}
+	}
+	return result
+}
+
+// render fills the template from a file. It fails when none of the referenced tags have a value,
+// and separators left dangling by missing tags are trimmed.
+func (t *labelTemplate) render(file DicomFile) (string, error) {
+	var b strings.Builder
+	found := false
+
+	for _, part := range t.parts {
+		if part.info == nil {
+			b.WriteString(part.literal)
+			continue
+		}
+
+		value := tag_value(file, *part.info)
+		if value != "" {
+			found = true
+		}
+
+		value, err := part.format(value)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+	}
+
+	label := strings.Trim(b.String(), " _-.")
+	if !found || label == "" {
+		return "", errors.New("No tags referenced by label template " + t.source + " are set")
+	}
+	return label, nil
+}
+
+func (part *labelPart) format(value string) (string, error) {
+	for _, f := range part.funcs {
+		switch f.name {
+		case "upper":
+			value = strings.ToUpper(value)
+		case "lower":
+			value = strings.ToLower(value)
+		case "default":
+			if value == "" {
+				value = f.arg
+			}
+		case "date":
+			if value == "" {
+				continue
+			}
+			parsed, err := time.Parse("20060102", value)
+			if err != nil {
+				return "", fmt.Errorf("%s value %q is not a date", part.info.Name, value)
+			}
+			value = parsed.Format(layoutOr(f.arg, "2006-01-02"))
+		case "time":
+			if value == "" {
+				continue
+			}
+			parsed, err := parse_dicom_time(value)
+			if err != nil {
+				return "", fmt.Errorf("%s value %q is not a time", part.info.Name, value)
+			}
+			value = parsed.Format(layoutOr(f.arg, "15:04:05"))
+		}
+	}
+	return value, nil
+}
+
+func layoutOr(layout, fallback string) string {
+	if layout == "" {
+		return fallback
+	}
+	return layout
+}
+
+// parse_dicom_time reads a TM value, which may omit seconds and minutes or carry a fraction.
+func parse_dicom_time(value string) (time.Time, error) {
+	if i := strings.Index(value, "."); i >= 0 {
+		value = value[:i]
+	}
+	switch len(value) {
+	case 2:
+		return time.Parse("15", value)
+	case 4:
+		return time.Parse("1504", value)
+	default:
+		return time.Parse("150405", value)
+	}
+}
+
+// tag_value returns the de-identified string form of a tag, or "" if the file does not have it.
+func tag_value(file DicomFile, info tag.TagInfo) string {
+	el, err := file.FindElementByTag(info.Tag)
+	if err != nil || el == nil {
+		return ""
+	}
+
+	var values []string
+	for _, x := range el.Value {
+		switch v := x.(type) {
+		case string:
+			values = append(values, strings.TrimSpace(v))
+		case []byte:
+			// Binary values are not meaningful in a label
+		default:
+			values = append(values, fmt.Sprint(v))
+		}
+	}
+
+	return deidProfile.Value(info.Name, strings.Join(values, "_"))
+}
+
+// session_label names a session from the --session-label template, falling back to the built-in naming.
+func session_label(file DicomFile) (string, error) {
+	if sessionTemplate != nil {
+		if label, err := sessionTemplate.render(file); err == nil {
+			return label, nil
+		}
+	}
+	return determine_name(file, "Study")
+}
+
+// acquisition_label names an acquisition from the --acquisition-label template, falling back to the built-in naming.
+func acquisition_label(file DicomFile) (string, error) {
+	if acquisitionTemplate != nil {
+		if label, err := acquisitionTemplate.render(file); err == nil {
+			return label, nil
+		}
+	}
+	return determine_name(file, "Series")
+}
+
+// subject_label picks the subject from the --subject template, falling back to PatientID as the profile leaves it.
+// While de-identifying, a --subject that cannot be rendered has no fallback, since the profile may keep PatientID
+// as it is, and a PatientID the profile removes is an error rather than an empty subject code.
+func subject_label(file DicomFile) (string, error) {
+	if subjectTemplate != nil {
+		code, err := subjectTemplate.render(file)
+		if err == nil {
+			return code, nil
+		}
+		if deidProfile != nil {
+			return "", err
+		}
+	}
+
+	code, err := extract_value(file, "PatientID")
+	if err == nil && code == "" && deidProfile != nil {
+		return "", errors.New("the profile removes PatientID")
+	}
+	return code, err
+}
+
+// template_tags lists every tag referenced by the label templates.
+func template_tags() []tag.Tag {
+	var result []tag.Tag
+	for _, t := range []*labelTemplate{sessionTemplate, acquisitionTemplate, subjectTemplate} {
+		result = append(result, t.tags()...)
+	}
+	return result
+}
@@ -0,0 +1,552 @@
+package dicom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	fp "path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	tag "github.com/grailbio/go-dicom/dicomtag"
+
+	"flywheel.io/sdk/api"
+
+	. "flywheel.io/fw/util"
+)
+
+// Defaults for the C-STORE receiver
+const (
+	DefaultPort        = 104
+	DefaultAETitle     = "FW"
+	DefaultQuietPeriod = 30 * time.Second
+)
+
+// ListenOptions configures a C-STORE receiver. The embedded ScanOptions apply to each study it imports.
+type ListenOptions struct {
+	ScanOptions
+
+	Port    int
+	AETitle string
+
+	// How long a study must go without new instances before it is imported
+	QuietPeriod time.Duration
+
+	// Folder to buffer received instances in; a temporary folder when empty
+	Spool string
+}
+
+// pendingStudy is a study still receiving instances, spooled to its own folder with a subfolder per series.
+type pendingStudy struct {
+	study_uid string
+	folder    string
+	series    map[string]int // Instances received per Series Instance UID
+	files     int
+	last      time.Time
+}
+
+// listener buffers received instances by study and imports each study once it goes quiet, so related series
+// can be grouped and split as they are when importing a folder.
+type listener struct {
+	client        *api.Client
+	group_id      string
+	group_label   string
+	project_label string
+	subjects      map[string]string
+	options       *ListenOptions
+
+	mutex   sync.Mutex
+	studies map[string]*pendingStudy // Key is Study Instance UID
+	held    map[string]string        // Folders of studies not fully imported, by Study Instance UID
+	closed  bool
+
+	// Sorts and uploads a spooled study. Returns the spooled files now in the project, and whether all were.
+	upload func(study *pendingStudy) ([]string, bool)
+
+	ready    chan *pendingStudy
+	imported int
+	failed   int
+}
+
+func new_listener(options *ListenOptions) *listener {
+	l := &listener{
+		options: options,
+		studies: map[string]*pendingStudy{},
+		held:    map[string]string{},
+		ready:   make(chan *pendingStudy, 64),
+	}
+	l.upload = l.upload_study
+	return l
+}
+
+// Listen receives DICOM instances over the network and imports each completed study into a project, the
+// same way Scan imports a folder. It runs until interrupted, then imports whatever studies are still pending.
+func Listen(client *api.Client, group_id string, project_label string, options *ListenOptions) {
+	group_label, project_label, subjects := prepare_scan(client, group_id, project_label, &options.ScanOptions)
+
+	if options.AETitle == "" {
+		options.AETitle = DefaultAETitle
+	}
+	if options.QuietPeriod <= 0 {
+		options.QuietPeriod = DefaultQuietPeriod
+	}
+
+	spool := options.Spool
+	temporary := spool == ""
+	if temporary {
+		dir, err := ioutil.TempDir("", "fw-dicom-listen")
+		Check(err)
+		spool = dir
+	} else {
+		Check(os.MkdirAll(spool, 0755))
+	}
+	options.Spool = spool
+
+	l := new_listener(options)
+	l.client = client
+	l.group_id, l.group_label, l.project_label = group_id, group_label, project_label
+	l.subjects = subjects
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", options.Port))
+	Check(err)
+
+	fmt.Println("Listening on port", options.Port, "as", options.AETitle+"; spooling to", spool)
+	fmt.Println("Studies are imported into", group_label+"/"+project_label, "after", options.QuietPeriod, "without new instances. Press Ctrl-C to stop.")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Println("\nStopping; importing pending studies. Press Ctrl-C again to stop now.")
+		ln.Close()
+
+		<-sigs
+		fmt.Println("\nStopped; pending studies were kept in", spool)
+		Fatal(1)
+	}()
+
+	l.run(ln)
+
+	if deidProfile != nil {
+		deidProfile.PrintSummary(os.Stdout)
+	}
+	if options.ReportPath != "" {
+		Check(importReport.Save(options.ReportPath))
+		fmt.Println("Wrote import report to", options.ReportPath)
+	}
+
+	fmt.Println("Imported", l.imported, "studies;", l.failed, "failed")
+	if l.failed > 0 {
+		fmt.Println("Instances of failed studies were kept in", spool)
+		Fatal(1)
+	}
+
+	if temporary {
+		os.RemoveAll(spool)
+	} else {
+		// Only removed when empty, as a folder given with --spool may hold other files
+		os.Remove(spool)
+	}
+}
+
+// run accepts associations until ln is closed, then imports the studies still pending and returns.
+func (l *listener) run(ln net.Listener) {
+	var importer sync.WaitGroup
+	importer.Add(1)
+	go func() {
+		defer importer.Done()
+		for study := range l.ready {
+			l.import_study(study)
+		}
+	}()
+
+	stopWatch := make(chan struct{})
+	go l.watch(stopWatch)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		go l.serve(conn)
+	}
+
+	close(stopWatch)
+	l.mutex.Lock()
+	l.closed = true
+	l.mutex.Unlock()
+	l.flush(0)
+	close(l.ready)
+	importer.Wait()
+}
+
+// watch hands studies that have gone quiet to the importer, until stopped.
+func (l *listener) watch(stop <-chan struct{}) {
+	interval := time.Second
+	if l.options.QuietPeriod < 2*interval {
+		interval = l.options.QuietPeriod / 2
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.flush(l.options.QuietPeriod)
+		}
+	}
+}
+
+// flush hands every study that has been quiet for at least quiet to the importer.
+func (l *listener) flush(quiet time.Duration) {
+	var quietStudies []*pendingStudy
+
+	l.mutex.Lock()
+	for key, study := range l.studies {
+		if time.Since(study.last) >= quiet {
+			delete(l.studies, key)
+			quietStudies = append(quietStudies, study)
+		}
+	}
+	l.mutex.Unlock()
+
+	// Sent outside the lock, so receiving carries on while the importer is busy
+	for _, study := range quietStudies {
+		l.ready <- study
+	}
+}
+
+// serve handles one association: negotiation, then C-ECHO and C-STORE requests until release.
+func (l *listener) serve(conn net.Conn) {
+	defer conn.Close()
+	peer := conn.RemoteAddr().String()
+
+	conn.SetReadDeadline(time.Now().Add(associationTimeout))
+	kind, pdu, err := read_pdu(conn)
+	if err != nil {
+		return
+	}
+	if kind != pduAssociateRQ {
+		write_pdu(conn, pduAbort, make([]byte, 4))
+		return
+	}
+
+	params, err := parse_associate(pdu)
+	if err != nil {
+		fmt.Println("Rejected association from", peer+":", err)
+		write_pdu(conn, pduAbort, make([]byte, 4))
+		return
+	}
+
+	// Rejected permanently by the service user: called AE title not recognized
+	if !strings.EqualFold(params.calledAE, l.options.AETitle) {
+		fmt.Println("Rejected association from", params.callingAE, "at", peer, "for AE title", params.calledAE)
+		write_pdu(conn, pduAssociateRJ, []byte{0, 1, 1, 7})
+		return
+	}
+
+	accepted := &associateParams{calledAE: params.calledAE, callingAE: params.callingAE}
+	syntaxes := map[byte]string{}
+	for _, pc := range params.contexts {
+		ts := choose_transfer_syntax(pc.transferSyntaxes)
+		result := &presentationContext{id: pc.id}
+		if ts == "" {
+			// Transfer syntaxes not supported
+			result.result = 4
+		} else {
+			result.transferSyntaxes = []string{ts}
+			syntaxes[pc.id] = ts
+		}
+		accepted.contexts = append(accepted.contexts, result)
+	}
+
+	err = write_pdu(conn, pduAssociateAC, encode_associate(pduAssociateAC, accepted))
+	if err != nil {
+		return
+	}
+
+	d := new_dul_conn(conn)
+	d.maxSend = params.maxLength
+	received := 0
+
+	for {
+		msg, err := d.next_message()
+		if err == errReleased || err == errAborted {
+			break
+		} else if err != nil {
+			fmt.Println("Association with", params.callingAE, "at", peer, "failed:", err)
+			write_pdu(conn, pduAbort, make([]byte, 4))
+			break
+		}
+
+		switch msg.command.uint16(elementCommandField) {
+		case commandEchoRQ:
+			err = d.send_message(msg.context, commandSet{
+				elementAffectedSOPClassUID:  ui(verificationUID),
+				elementCommandField:         us(commandEchoRSP),
+				elementMessageIDRespondedTo: msg.command[elementMessageID],
+				elementCommandDataSetType:   us(noDataSet),
+				elementStatus:               us(statusSuccess),
+			}, nil)
+
+		case commandStoreRQ:
+			sopClass := msg.command.string(elementAffectedSOPClassUID)
+			sop := msg.command.string(elementAffectedSOPInstanceUID)
+
+			status := l.store(params.callingAE, sopClass, sop, syntaxes[msg.context], msg.data)
+			if status == statusSuccess {
+				received++
+			}
+
+			err = d.send_message(msg.context, commandSet{
+				elementAffectedSOPClassUID:    ui(sopClass),
+				elementCommandField:           us(commandStoreRSP),
+				elementMessageIDRespondedTo:   msg.command[elementMessageID],
+				elementCommandDataSetType:     us(noDataSet),
+				elementStatus:                 us(status),
+				elementAffectedSOPInstanceUID: ui(sop),
+			}, nil)
+
+		default:
+			fmt.Println("Unsupported request from", params.callingAE, "at", peer+"; aborting")
+			write_pdu(conn, pduAbort, make([]byte, 4))
+			return
+		}
+
+		if err != nil {
+			fmt.Println("Association with", params.callingAE, "at", peer, "failed:", err)
+			return
+		}
+	}
+
+	if received > 0 {
+		fmt.Println("Received", received, "instances from", params.callingAE, "at", peer)
+	}
+}
+
+// choose_transfer_syntax prefers explicit, then implicit little endian, and otherwise takes the first proposed.
+func choose_transfer_syntax(proposed []string) string {
+	for _, preferred := range []string{transferExplicitLittle, transferImplicitLittle} {
+		for _, ts := range proposed {
+			if ts == preferred {
+				return ts
+			}
+		}
+	}
+	if len(proposed) > 0 {
+		return proposed[0]
+	}
+	return ""
+}
+
+// store spools one received instance as a DICOM file in the folder of its study and series. Returns a DIMSE status.
+func (l *listener) store(callingAE, sopClass, sop, transferSyntax string, data []byte) uint16 {
+	raw := part10(sopClass, sop, transferSyntax, callingAE, data)
+
+	dataset, err := dicom.ReadDataSetInBytes(raw, dicom.ReadOptions{
+		DropPixelData: true,
+		ReturnTags:    []tag.Tag{tag.StudyInstanceUID, tag.SeriesInstanceUID},
+	})
+	if err != nil {
+		fmt.Println("Could not read instance", sop+":", err)
+		return statusCannotUnderstand
+	}
+
+	file := DicomFile{DataSet: dataset}
+	study_uid, err := extract_value(file, "StudyInstanceUID")
+	if err != nil {
+		return statusCannotUnderstand
+	}
+	series_uid, err := extract_value(file, "SeriesInstanceUID")
+	if err != nil {
+		return statusCannotUnderstand
+	}
+	study_uid, series_uid = strings.TrimSpace(study_uid), strings.TrimSpace(series_uid)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return statusOutOfResources
+	}
+
+	study, ok := l.studies[study_uid]
+	if !ok {
+		// A study that was not fully imported carries on in its folder, so what was held back is imported with it
+		folder, held := l.held[study_uid]
+		if held {
+			delete(l.held, study_uid)
+		} else {
+			folder = fp.Join(l.options.Spool, fmt.Sprintf("%s-%d", sanitize_name(study_uid), time.Now().UnixNano()))
+		}
+		study = &pendingStudy{study_uid: study_uid, folder: folder, series: map[string]int{}}
+		l.studies[study_uid] = study
+	}
+
+	folder := fp.Join(study.folder, sanitize_name(series_uid))
+	err = os.MkdirAll(folder, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(fp.Join(folder, sanitize_name(sop)+".dcm"), raw, 0644)
+	}
+	if err != nil {
+		fmt.Println("Could not spool instance", sop+":", err)
+		return statusOutOfResources
+	}
+
+	study.series[series_uid]++
+	study.files++
+	study.last = time.Now()
+	return statusSuccess
+}
+
+// import_study sorts and uploads one spooled study, removing from the spool what was uploaded.
+// Series held back or failing to upload are left in the spool, and imported again if the study receives more
+// instances.
+func (l *listener) import_study(study *pendingStudy) {
+	fmt.Printf("\nImporting study %s (%d series, %d instances)\n", study.study_uid, len(study.series), study.files)
+
+	uploaded, ok := l.upload(study)
+	for _, path := range uploaded {
+		os.Remove(path)
+	}
+
+	if !ok {
+		l.failed++
+		remove_empty_folders(study.folder)
+
+		folder := study.folder
+		l.mutex.Lock()
+		if pending, more := l.studies[study.study_uid]; more {
+			// More of the study arrived while it was importing, into a folder of its own; join it there
+			folder = pending.folder
+			pending.files += move_spooled(study.folder, folder)
+		} else {
+			l.held[study.study_uid] = folder
+		}
+		l.mutex.Unlock()
+
+		fmt.Println("Study", study.study_uid, "was not fully imported; the rest of its instances are in", folder)
+		return
+	}
+
+	l.imported++
+	err := os.RemoveAll(study.folder)
+	if err != nil {
+		fmt.Println("Could not remove", study.folder+":", err)
+	}
+
+	if !l.options.Quiet {
+		fmt.Println("Imported study", study.study_uid)
+	}
+}
+
+// move_spooled moves the instances of one spooled study into the folder of another, returning how many it moved.
+// Instances received again keep their newer copy.
+func move_spooled(from, to string) int {
+	moved := 0
+	paths, _ := fp.Glob(fp.Join(from, "*", "*"))
+	for _, path := range paths {
+		rel, _ := fp.Rel(from, path)
+		target := fp.Join(to, rel)
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		err := os.MkdirAll(fp.Dir(target), 0755)
+		if err == nil {
+			err = os.Rename(path, target)
+		}
+		if err != nil {
+			fmt.Println("Could not move", path+":", err)
+			return moved
+		}
+		moved++
+	}
+	os.RemoveAll(from)
+	return moved
+}
+
+// remove_empty_folders removes the series folders of a study that no longer hold any instances.
+func remove_empty_folders(folder string) {
+	entries, _ := ioutil.ReadDir(folder)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			os.Remove(fp.Join(folder, entry.Name()))
+		}
+	}
+}
+
+// upload_study sorts and uploads a spooled study. Series held back by --require-complete, files that failed to
+// read, and acquisitions that failed to upload keep the study from being complete, but the rest is uploaded.
+func (l *listener) upload_study(study *pendingStudy) ([]string, bool) {
+	options := l.options
+	reset_scan()
+
+	sessions, err := collect_sessions(study.folder, options.Workers, true)
+	if err != nil {
+		fmt.Println("Could not read", study.folder+":", err)
+		return nil, false
+	}
+
+	if l.subjects != nil {
+		unmapped := apply_subject_map(sessions, l.subjects, options.Unmapped)
+		if len(unmapped) > 0 {
+			printUnmapped(unmapped, options.Unmapped)
+			if options.Unmapped == UnmappedFail {
+				return nil, false
+			}
+		}
+	}
+
+	err = find_existing(l.client, l.group_id, l.project_label, sessions)
+	if err != nil {
+		fmt.Println("Could not check for existing series:", err)
+		return nil, false
+	}
+
+	if !options.NoTree {
+		printTree(sessions, l.group_label, l.project_label)
+	}
+	complete := true
+	if options.RequireComplete {
+		held := hold_incomplete(sessions)
+		printIncomplete(held)
+		complete = len(held) == 0
+	}
+	printExclusions()
+
+	if conflictPolicy == ConflictFail && len(exclusions) > 0 {
+		fmt.Println("Not uploading: files were excluded and --on-conflict is", ConflictFail)
+		return nil, false
+	}
+	for _, x := range exclusions {
+		if x.Failed {
+			complete = false
+		}
+	}
+
+	failed := map[*Acquisition]bool{}
+	for _, acq := range upload_dicoms(sessions, l.client, l.group_id, l.project_label, options.Quiet, options.Jobs, options.Retries) {
+		failed[acq] = true
+	}
+
+	var uploaded []string
+	for _, session := range sessions {
+		for _, acq := range session.Acquisitions {
+			if failed[acq] {
+				continue
+			}
+			for _, file := range acq.Files {
+				uploaded = append(uploaded, file.Path)
+			}
+		}
+	}
+	return uploaded, complete && len(failed) == 0
+}
@@ -0,0 +1,200 @@
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	fp "path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testSOPClass = "1.2.840.10008.5.1.4.1.1.4" // MR Image Storage
+
+// write_element writes a data set element in explicit VR little endian.
+func write_element(w *bytes.Buffer, group, element uint16, vr string, value []byte) {
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint16(header[0:2], group)
+	binary.LittleEndian.PutUint16(header[2:4], element)
+	copy(header[4:6], vr)
+	binary.LittleEndian.PutUint16(header[6:8], uint16(len(value)))
+	w.Write(header)
+	w.Write(value)
+}
+
+// write_instance writes a minimal DICOM file for one instance of a series.
+func write_instance(t *testing.T, dir, study, series, sop string) {
+	var data bytes.Buffer
+	write_element(&data, 0x0008, 0x0016, "UI", ui(testSOPClass))
+	write_element(&data, 0x0008, 0x0018, "UI", ui(sop))
+	write_element(&data, 0x0020, 0x000D, "UI", ui(study))
+	write_element(&data, 0x0020, 0x000E, "UI", ui(series))
+
+	raw := part10(testSOPClass, sop, transferExplicitLittle, "TEST", data.Bytes())
+	err := ioutil.WriteFile(fp.Join(dir, sop+".dcm"), raw, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// spooled lists the instances of a pending study, by series folder and file name.
+func spooled(t *testing.T, study *pendingStudy) []string {
+	paths, err := fp.Glob(fp.Join(study.folder, "*", "*.dcm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, path := range paths {
+		rel, _ := fp.Rel(study.folder, path)
+		result = append(result, fp.ToSlash(rel))
+	}
+	return result
+}
+
+// start_listener runs a listener on a free local port, with uploads replaced by upload.
+func start_listener(t *testing.T, quiet time.Duration, upload func(study *pendingStudy) ([]string, bool)) (string, func()) {
+	l := new_listener(&ListenOptions{
+		AETitle:     "FW",
+		QuietPeriod: quiet,
+		Spool:       t.TempDir(),
+	})
+	l.upload = upload
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.run(ln)
+		close(done)
+	}()
+
+	stop := func() {
+		ln.Close()
+		<-done
+	}
+	return ln.Addr().String(), stop
+}
+
+func TestListenRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	write_instance(t, dir, "1.2.3", "1.2.3.1", "1.2.3.1.1")
+	write_instance(t, dir, "1.2.3", "1.2.3.1", "1.2.3.1.2")
+	write_instance(t, dir, "1.2.3", "1.2.3.2", "1.2.3.2.1")
+
+	var studies []*pendingStudy
+	address, stop := start_listener(t, time.Hour, func(study *pendingStudy) ([]string, bool) {
+		if files := spooled(t, study); len(files) != study.files {
+			t.Errorf("spooled %d files for %d instances", len(files), study.files)
+		}
+		studies = append(studies, study)
+		return nil, true
+	})
+
+	err := echo_scp(address, "FW", "TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent, total, err := send_files(address, "FW", "TEST", []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 3 || total != 3 {
+		t.Fatalf("sent %d of %d files, want 3 of 3", sent, total)
+	}
+
+	stop()
+
+	if len(studies) != 1 {
+		t.Fatalf("imported %d studies, want the series of one study imported together", len(studies))
+	}
+	study := studies[0]
+	if study.study_uid != "1.2.3" || study.files != 3 {
+		t.Errorf("got study %s with %d instances, want 1.2.3 with 3", study.study_uid, study.files)
+	}
+	want := map[string]int{"1.2.3.1": 2, "1.2.3.2": 1}
+	if !reflect.DeepEqual(study.series, want) {
+		t.Errorf("got series %v, want %v", study.series, want)
+	}
+}
+
+func TestListenRejectsOtherAETitles(t *testing.T) {
+	address, stop := start_listener(t, time.Hour, func(study *pendingStudy) ([]string, bool) {
+		t.Error("nothing should be imported")
+		return nil, true
+	})
+	defer stop()
+
+	err := echo_scp(address, "OTHER", "TEST")
+	if err == nil {
+		t.Fatal("association for another AE title was accepted")
+	}
+}
+
+func TestListenKeepsSeriesHeldBack(t *testing.T) {
+	dir := t.TempDir()
+	write_instance(t, dir, "1.2.3", "1.2.3.1", "1.2.3.1.1")
+	write_instance(t, dir, "1.2.3", "1.2.3.2", "1.2.3.2.1")
+
+	imports := make(chan []string)
+	held := true
+	address, stop := start_listener(t, 100*time.Millisecond, func(study *pendingStudy) ([]string, bool) {
+		files := spooled(t, study)
+		imports <- files
+
+		// The first time, only the first series is complete enough to upload
+		if held {
+			held = false
+			return []string{fp.Join(study.folder, "1.2.3.1", "1.2.3.1.1.dcm")}, false
+		}
+		var paths []string
+		for _, file := range files {
+			paths = append(paths, fp.Join(study.folder, file))
+		}
+		return paths, true
+	})
+	defer stop()
+
+	_, _, err := send_files(address, "FW", "TEST", []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-imports, []string{"1.2.3.1/1.2.3.1.1.dcm", "1.2.3.2/1.2.3.2.1.dcm"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("first import got %v, want %v", got, want)
+	}
+
+	// More of the study arrives, and is imported along with the series held back
+	more := t.TempDir()
+	write_instance(t, more, "1.2.3", "1.2.3.2", "1.2.3.2.2")
+	_, _, err = send_files(address, "FW", "TEST", []string{more})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-imports, []string{"1.2.3.2/1.2.3.2.1.dcm", "1.2.3.2/1.2.3.2.2.dcm"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("second import got %v, want %v", got, want)
+	}
+}
+
+func TestDataSetSizeLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	d := new_dul_conn(server)
+	d.maxData = 64
+
+	go new_dul_conn(client).send_message(1, commandSet{
+		elementCommandField:       us(commandStoreRQ),
+		elementCommandDataSetType: us(0),
+	}, make([]byte, 100))
+
+	_, err := d.next_message()
+	if err == nil {
+		t.Fatal("a data set over the limit was accepted")
+	}
+}
@@ -0,0 +1,394 @@
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	fp "path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"flywheel.io/sdk/api"
+
+	. "flywheel.io/fw/util"
+)
+
+// Where recognized non-DICOM files found among the series are uploaded.
+const (
+	AttachSession     = "session"
+	AttachAcquisition = "acquisition"
+	AttachNone        = "none"
+)
+
+// Kinds of non-DICOM files. Only PDFs, images and text are recognized as worth attaching.
+const (
+	OtherPDF      = "pdf"
+	OtherImage    = "image"
+	OtherText     = "text"
+	OtherArchive  = "archive"
+	OtherRawDicom = "dicom without file meta"
+	OtherSystem   = "system file"
+	OtherEmpty    = "empty"
+	OtherUnknown  = "unknown"
+)
+
+var attachPolicy = AttachNone
+
+// OtherFile is a file found among the series that is not a DICOM file.
+type OtherFile struct {
+	Path string
+	Kind string
+
+	// Set when the file will be uploaded as an attachment
+	Container string
+
+	rel  string
+	open func() (io.ReadCloser, error)
+}
+
+var others []*OtherFile
+var othersMutex sync.Mutex
+
+func setAttachPolicy(policy string) error {
+	switch policy {
+	case "":
+		attachPolicy = AttachNone
+	case AttachSession, AttachAcquisition, AttachNone:
+		attachPolicy = policy
+	default:
+		return errors.New("Unknown attach policy " + policy + "; use " + AttachSession + ", " + AttachAcquisition + " or " + AttachNone)
+	}
+	return nil
+}
+
+// sniffLength is how much of a file is read to tell what it is
+const sniffLength = 512
+
+// classify_other tells what a file that failed to parse as DICOM is. Returns an empty string for files that have
+// the DICM prefix, which are DICOM files that are damaged rather than something else.
+func classify_other(x walkedFile) (string, error) {
+	name := fp.Base(x.path)
+
+	var reader io.ReadCloser
+	var err error
+	if x.open != nil {
+		reader, err = x.open()
+	} else {
+		reader, err = os.Open(x.path)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+
+	switch {
+	case len(head) >= 132 && string(head[128:132]) == "DICM":
+		return "", nil
+	case strings.HasPrefix(name, "._") || name == ".DS_Store" || strings.EqualFold(name, "Thumbs.db") || strings.EqualFold(name, "desktop.ini"):
+		return OtherSystem, nil
+	case len(head) == 0:
+		return OtherEmpty, nil
+	case bytes.HasPrefix(head, []byte("%PDF")):
+		return OtherPDF, nil
+	case is_image(head):
+		return OtherImage, nil
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte{0x1f, 0x8b}) || (len(head) >= 262 && string(head[257:262]) == "ustar"):
+		return OtherArchive, nil
+	case is_raw_dicom(head):
+		return OtherRawDicom, nil
+	case is_text(head):
+		return OtherText, nil
+	}
+	return OtherUnknown, nil
+}
+
+func is_image(head []byte) bool {
+	for _, magic := range [][]byte{
+		{0x89, 'P', 'N', 'G'},
+		{0xff, 0xd8, 0xff},
+		[]byte("GIF8"),
+		[]byte("II*\x00"),
+		[]byte("MM\x00*"),
+		[]byte("BM"),
+	} {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// is_raw_dicom recognizes a data set written without the preamble and file meta, which starts with a
+// low group number in little endian.
+func is_raw_dicom(head []byte) bool {
+	if len(head) < 8 {
+		return false
+	}
+	group := binary.LittleEndian.Uint16(head[0:2])
+	return group == 0x0008 || group == 0x0002
+}
+
+func is_text(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	// The sniffed bytes may end in the middle of a character
+	for i := 0; i < utf8.UTFMax && len(head) > 0; i++ {
+		if utf8.Valid(head) {
+			return true
+		}
+		head = head[:len(head)-1]
+	}
+	return utf8.Valid(head)
+}
+
+// skip_other records a file that is not DICOM, keeping what is needed to attach it later.
+func skip_other(x walkedFile, kind string) {
+	atomic.AddInt64(&files_skipped, 1)
+
+	other := &OtherFile{Path: x.path, Kind: kind, rel: x.rel}
+	if attachable(kind) {
+		other.open = x.open
+	}
+
+	othersMutex.Lock()
+	others = append(others, other)
+	othersMutex.Unlock()
+}
+
+func attachable(kind string) bool {
+	return kind == OtherPDF || kind == OtherImage || kind == OtherText
+}
+
+// attachment is an OtherFile on its way to a session or acquisition.
+type attachment struct {
+	file        *OtherFile
+	name        string
+	session     api.Session
+	acquisition *api.Acquisition
+}
+
+// plan_attachments decides where each recognized non-DICOM file goes: the session or acquisition of the DICOM
+// files in the same folder, or failing that the nearest folder above it. Files whose folder holds more than one
+// session or acquisition are not attached.
+func plan_attachments(sessions map[string]Session) []*attachment {
+	if attachPolicy == AttachNone {
+		return nil
+	}
+
+	type target struct {
+		study_uid  string
+		series_uid string
+	}
+	folders := map[string]map[target]bool{}
+
+	for study_uid, session := range sessions {
+		for series_uid, acq := range session.Acquisitions {
+			t := target{study_uid: study_uid}
+			if attachPolicy == AttachAcquisition {
+				t.series_uid = series_uid
+			}
+			for _, file := range acq.Files {
+				dir := path.Dir(file.rel)
+				if folders[dir] == nil {
+					folders[dir] = map[target]bool{}
+				}
+				folders[dir][t] = true
+			}
+		}
+	}
+
+	var result []*attachment
+	names := map[string]*uniqueNames{}
+
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].Path < others[j].Path
+	})
+
+	for _, other := range others {
+		if !attachable(other.Kind) {
+			continue
+		}
+
+		var targets map[target]bool
+		for dir := path.Dir(other.rel); ; dir = path.Dir(dir) {
+			if targets = folders[dir]; targets != nil || dir == "." || dir == "/" {
+				break
+			}
+		}
+		if len(targets) != 1 {
+			continue
+		}
+
+		var t target
+		for x := range targets {
+			t = x
+		}
+		session := sessions[t.study_uid]
+		x := &attachment{file: other, session: session.SdkSession}
+		container := session.SdkSession.Name
+		if t.series_uid != "" {
+			x.acquisition = &session.Acquisitions[t.series_uid].SdkAcquisition
+			container += "/" + x.acquisition.Name
+		}
+
+		if names[container] == nil {
+			names[container] = newUniqueNames()
+		}
+		x.name = attachment_name(names[container], other.Path, path.Base(other.rel))
+		other.Container = container
+		result = append(result, x)
+	}
+	return result
+}
+
+// attachment_name keeps the file name, numbering it before the extension if the container already has one.
+func attachment_name(names *uniqueNames, key, name string) string {
+	ext := path.Ext(name)
+	base := names.name(key, strings.TrimSuffix(name, ext))
+	return base + ext
+}
+
+// upload_attachments uploads the planned attachments next to the DICOM series they were found with.
+func upload_attachments(attachments []*attachment, c *api.Client, group_id string, project_label string, quiet bool, retries int) int {
+	failed := 0
+
+	for _, x := range attachments {
+		start := time.Now()
+		var written int64
+
+		_, err := with_retries(x.file.Path, retries, func() error {
+			var err error
+			written, err = upload_attachment(c, x, group_id, project_label)
+			return err
+		})
+
+		status, errString := FileUploaded, ""
+		if err != nil {
+			status, errString = FileFailed, err.Error()
+			failed++
+			fmt.Println("Failed to attach", x.file.Path+":", err)
+		} else if !quiet {
+			fmt.Println("Attached", x.name, "to", x.file.Container)
+		}
+
+		importReport.AddFile(&ReportFile{
+			Name:      x.name,
+			Path:      x.file.Path,
+			Container: x.file.Container,
+			Status:    status,
+			Bytes:     written,
+			Duration:  time.Since(start).Seconds(),
+			Error:     errString,
+		})
+	}
+	return failed
+}
+
+func upload_attachment(c *api.Client, x *attachment, group_id string, project_label string) (int64, error) {
+	files := []interface{}{
+		map[string]interface{}{
+			"name": x.name,
+		},
+	}
+
+	session := map[string]interface{}{
+		"uid":   x.session.Uid,
+		"label": x.session.Name,
+		"subject": map[string]interface{}{
+			"code": x.session.Subject.Code,
+		},
+	}
+	metadata := map[string]interface{}{
+		"group": map[string]interface{}{
+			"_id": group_id,
+		},
+		"project": map[string]interface{}{
+			"label": project_label,
+		},
+		"session": session,
+	}
+
+	if x.acquisition != nil {
+		metadata["acquisition"] = map[string]interface{}{
+			"uid":   x.acquisition.Uid,
+			"label": x.acquisition.Name,
+			"files": files,
+		}
+	} else {
+		session["files"] = files
+	}
+
+	metadata_bytes, err := json.Marshal(metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	var reader io.ReadCloser
+	if x.file.open != nil {
+		reader, err = x.file.open()
+	} else {
+		reader, err = os.Open(x.file.Path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	src := &api.UploadSource{Name: x.name, Reader: reader}
+	prog, errc := c.UploadSimple("upload/uid", metadata_bytes, src)
+
+	var written int64
+	for update := range prog {
+		written = int64(update)
+	}
+	return written, <-errc
+}
+
+// printOthers summarizes the files that are not DICOM by kind, and lists them along with where each is attached.
+func printOthers(quiet bool) {
+	if len(others) == 0 {
+		return
+	}
+
+	counts := map[string]int{}
+	for _, other := range others {
+		counts[other.Kind]++
+	}
+	var kinds []string
+	for kind, n := range counts {
+		kinds = append(kinds, fmt.Sprintf("%d %s", n, kind))
+	}
+	sort.Strings(kinds)
+
+	fmt.Println("Skipped", len(others), "files that are not DICOM:", strings.Join(kinds, ", "))
+	if !quiet {
+		sort.Slice(others, func(i, j int) bool {
+			return others[i].Path < others[j].Path
+		})
+		for _, other := range others {
+			note := other.Kind
+			if other.Container != "" {
+				note += ", attached to " + other.Container
+			}
+			fmt.Println("  " + other.Path + " (" + note + ")")
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,249 @@
+package dicom
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	tag "github.com/grailbio/go-dicom/dicomtag"
+
+	"flywheel.io/sdk/api"
+)
+
+// Related acquisitions: series that belong together are grouped into one acquisition, and series holding several
+// echoes or phases are split into one acquisition each. Series are grouped first, then split.
+
+// Tags series are split by when related acquisitions are on and no --split-by is given
+var defaultSplitTags = []string{"EchoNumbers", "TemporalPositionIdentifier"}
+
+// seriesRange groups the series of a study whose SeriesNumber falls within it.
+type seriesRange struct {
+	first int
+	last  int
+}
+
+func (r seriesRange) String() string {
+	return fmt.Sprintf("%d-%d", r.first, r.last)
+}
+
+// Settings for this scan; all off means every series is its own acquisition
+var groupByFrame bool
+var seriesRanges []seriesRange
+var splitTags []tag.TagInfo
+
+// setRelatedAcquisitions configures grouping by frame of reference and by series number range, and splitting by
+// tags. Grouping by frame of reference splits by EchoNumbers and TemporalPositionIdentifier unless splitBy is given.
+func setRelatedAcquisitions(byFrame bool, ranges []string, splitBy []string) error {
+	groupByFrame = byFrame
+	seriesRanges = nil
+	splitTags = nil
+
+	for _, x := range ranges {
+		r, err := parseSeriesRange(x)
+		if err != nil {
+			return err
+		}
+		for _, other := range seriesRanges {
+			if r.first <= other.last && other.first <= r.last {
+				return errors.New("Series number ranges " + other.String() + " and " + r.String() + " overlap")
+			}
+		}
+		seriesRanges = append(seriesRanges, r)
+	}
+
+	if byFrame && len(splitBy) == 0 {
+		splitBy = defaultSplitTags
+	}
+	tags, err := find_tags(splitBy)
+	if err != nil {
+		return err
+	}
+	splitTags = tags
+
+	return nil
+}
+
+func parseSeriesRange(x string) (seriesRange, error) {
+	bounds := strings.SplitN(strings.TrimSpace(x), "-", 2)
+	if len(bounds) != 2 {
+		return seriesRange{}, errors.New("Invalid series number range " + x + "; use first-last, e.g. 2-5")
+	}
+
+	first, err1 := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	last, err2 := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err1 != nil || err2 != nil || first > last {
+		return seriesRange{}, errors.New("Invalid series number range " + x + "; use first-last, e.g. 2-5")
+	}
+	return seriesRange{first: first, last: last}, nil
+}
+
+func relating() bool {
+	return groupByFrame || len(seriesRanges) > 0 || len(splitTags) > 0
+}
+
+// related_tags are the tags grouping and splitting read, beyond those the import always reads.
+func related_tags() []tag.Tag {
+	var result []tag.Tag
+	if groupByFrame {
+		result = append(result, tag.FrameOfReferenceUID)
+	}
+	for _, info := range splitTags {
+		result = append(result, info.Tag)
+	}
+	return result
+}
+
+// relate_acquisitions regroups the acquisitions of every session as configured.
+func relate_acquisitions(sessions map[string]Session) {
+	for _, session := range sessions {
+		group_series(session)
+		split_series(session)
+	}
+}
+
+// series_number is the SeriesNumber of an acquisition, or -1 when it has none.
+func series_number(acq *Acquisition) int {
+	for _, file := range acq.Files {
+		value, err := extract_value(file, "SeriesNumber")
+		if err != nil {
+			return -1
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	return -1
+}
+
+// group_key decides which group, if any, an acquisition joins. Series number ranges take precedence.
+func group_key(acq *Acquisition) string {
+	n := series_number(acq)
+	for _, r := range seriesRanges {
+		if n >= r.first && n <= r.last {
+			return "series " + r.String()
+		}
+	}
+
+	if groupByFrame {
+		for _, file := range acq.Files {
+			frame := find_value(file, tag.TagInfo{Tag: tag.FrameOfReferenceUID})
+			if frame != "" {
+				return "frame " + frame
+			}
+		}
+	}
+	return ""
+}
+
+// group_series merges the acquisitions of a session that belong together. The merged acquisition keeps the uid
+// and label of its lowest-numbered series, so importing the same files again finds it.
+func group_series(session Session) {
+	if !groupByFrame && len(seriesRanges) == 0 {
+		return
+	}
+
+	groups := map[string][]string{}
+	for series_uid, acq := range session.Acquisitions {
+		if key := group_key(acq); key != "" {
+			groups[key] = append(groups[key], series_uid)
+		}
+	}
+
+	for _, members := range groups {
+		if len(members) < 2 {
+			continue
+		}
+
+		sort.Slice(members, func(i, j int) bool {
+			a, b := session.Acquisitions[members[i]], session.Acquisitions[members[j]]
+			if na, nb := series_number(a), series_number(b); na != nb {
+				return na < nb
+			}
+			return members[i] < members[j]
+		})
+
+		base := session.Acquisitions[members[0]]
+		base.Related = append(base.Related, members[0])
+
+		for _, series_uid := range members[1:] {
+			acq := session.Acquisitions[series_uid]
+			for sop, file := range acq.Files {
+				if existing_file, exists := base.Files[sop]; exists {
+					// Both copies were counted when sorted; resolving counts whichever is kept
+					atomic.AddInt64(&dicoms_found, -1)
+					resolve_conflict(base, sop, existing_file, file)
+				} else {
+					base.Files[sop] = file
+				}
+			}
+			base.Related = append(base.Related, series_uid)
+			base.Warnings = append(base.Warnings, acq.Warnings...)
+			delete(session.Acquisitions, series_uid)
+			acquisitions_found--
+		}
+	}
+}
+
+// split_series breaks up acquisitions whose files differ in the split tags, such as the echoes of a multi-echo
+// series. Each part gets the uid of its series suffixed with the tag values, and a label saying which part it is.
+func split_series(session Session) {
+	if len(splitTags) == 0 {
+		return
+	}
+
+	var series_uids []string
+	for series_uid := range session.Acquisitions {
+		series_uids = append(series_uids, series_uid)
+	}
+
+	for _, series_uid := range series_uids {
+		acq := session.Acquisitions[series_uid]
+
+		parts := map[string]map[string]DicomFile{}
+		labels := map[string]string{}
+		for sop, file := range acq.Files {
+			var values, label []string
+			for _, info := range splitTags {
+				value := find_value(file, info)
+				values = append(values, value)
+				if value != "" {
+					label = append(label, info.Name+" "+tag_value(file, info))
+				}
+			}
+
+			key := strings.Join(values, "_")
+			if parts[key] == nil {
+				parts[key] = map[string]DicomFile{}
+				labels[key] = strings.Join(label, ", ")
+			}
+			parts[key][sop] = file
+		}
+		if len(parts) < 2 {
+			continue
+		}
+
+		delete(session.Acquisitions, series_uid)
+		acquisitions_found--
+
+		for key, files := range parts {
+			uid := series_uid + "_" + sanitize_name(normalize_uid(key))
+			name := acq.SdkAcquisition.Name
+			if labels[key] != "" {
+				name += " - " + labels[key]
+			}
+
+			session.Acquisitions[uid] = &Acquisition{
+				SdkAcquisition: api.Acquisition{Name: name, Uid: uid},
+				Files:          files,
+				Related:        acq.Related,
+				Warnings:       acq.Warnings,
+			}
+			acquisitions_found++
+		}
+	}
+}
@@ -6,18 +6,19 @@ import (
 	prompt "github.com/segmentio/go-prompt"
 
 	humanize "github.com/dustin/go-humanize"
-	fp "path/filepath"
-
-	"github.com/udhos/equalfile"
 
 	"archive/zip"
 	"encoding/json"
+	"errors"
 	"flywheel.io/sdk/api"
 	"fmt"
 	"io"
 	"os"
+	fp "path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	. "flywheel.io/fw/util"
 )
@@ -25,30 +26,128 @@ import (
 type DicomFile struct {
 	*dicom.DataSet
 	Path string
+
+	// Set when the file was read from an archive rather than loose on disk
+	Archive string
+	Member  string
+
+	// Position in walk order, and path below the walked folder or archive
+	order   int
+	rel     string
+	modTime time.Time
 }
 
 type Acquisition struct {
 	SdkAcquisition api.Acquisition
 	Files          map[string]DicomFile // Key is SOP Instance UID
+	Existing       *ExistingSeries      // Set if the project already has this series
+	Related        []string             // Series Instance UIDs grouped into this acquisition, if more than one
+	Warnings       []string             // Signs the series is incomplete or mixed, from check_series
 }
 
 type Session struct {
 	SdkSession   api.Session
 	Acquisitions map[string]*Acquisition // Key is Series Instance UID
+	PatientID    string                  // As found in the files, before mapping or de-identification
+	ExistingId   string                  // Set if the project already has this study
 }
 
 var sessions_found = 0
 var acquisitions_found = 0
-var dicoms_found = 0
+var dicoms_found int64 = 0
 var sessions_uploaded = 0
 var acquisitions_uploaded = 0
-var files_skipped = 0
+var files_skipped int64 = 0
+
+var importReport *ImportReport
+var deidProfile *DeidProfile
+
+// ScanOptions configures a DICOM import.
+type ScanOptions struct {
+	// Group series sharing a frame of reference into one acquisition
+	RelatedAcq bool
+
+	// SeriesNumber ranges whose series are grouped into one acquisition, e.g. "2-5"
+	RelatedSeries []string
+
+	// Tags to split series by, e.g. EchoNumbers; defaults to echo and temporal position with RelatedAcq
+	SplitBy []string
+
+	Quiet  bool
+	NoTree bool
+	Local  bool
+
+	// Optional path to write a JSON import report to
+	ReportPath string
+
+	// Optional YAML de-identification profile, applied to uploaded files and derived labels
+	DeidProfile string
+
+	// Number of files to parse at once; defaults to DefaultWorkers
+	Workers int
+
+	// What to do with files that share a SOPInstanceUID but differ: skip, first, last or fail
+	OnConflict string
+
+	// Optional label templates, e.g. "{StudyDate|date}_{StudyDescription}"
+	SessionLabel     string
+	AcquisitionLabel string
+	Subject          string
+
+	// Optional CSV of PatientID to subject code, and what to do with patients missing from it: skip, fail or keep
+	SubjectMap string
+	Unmapped   string
+
+	// What to do with series the project already has: skip, append or replace
+	Existing string
+
+	// Number of acquisitions to upload at once, and how often to retry each one
+	Jobs    int
+	Retries int
+
+	// How acquisition zip members are named and compressed
+	ZipNaming   string
+	Compression string
+
+	// Leave out series that look incomplete or mixed instead of only warning about them
+	RequireComplete bool
+
+	// Where to upload PDFs, images and text files found among the series: session, acquisition or none
+	AttachOther string
+}
 
 // TODO: check for group permissions before scanning
 
-// replace panics with {return err}
+// prepare_scan applies the options shared by every import and checks the destination.
+// Returns the group and project labels, and the subject map if one was given.
+func prepare_scan(client *api.Client, group_id string, project_label string, options *ScanOptions) (string, string, map[string]string) {
+	importReport = NewImportReport()
+	Check(setConflictPolicy(options.OnConflict))
+	Check(setLabelTemplates(options.SessionLabel, options.AcquisitionLabel, options.Subject))
+	Check(setExistingPolicy(options.Existing))
+	Check(setRelatedAcquisitions(options.RelatedAcq, options.RelatedSeries, options.SplitBy))
+	Check(setZipOptions(options.ZipNaming, options.Compression))
+	Check(setAttachPolicy(options.AttachOther))
+
+	var subjects map[string]string
+	if options.SubjectMap != "" {
+		Check(checkUnmappedPolicy(options.Unmapped))
+		subjectMap, err := LoadSubjectMap(options.SubjectMap)
+		Check(err)
+		subjects = subjectMap
+	}
+
+	if options.DeidProfile != "" {
+		profile, err := LoadDeidProfile(options.DeidProfile)
+		Check(err)
+		deidProfile = profile
+
+		// Attachments are uploaded byte for byte, so they would get past the profile
+		if attachPolicy != AttachNone {
+			Check(errors.New("--attach-other cannot be used with --deid-profile, as other files are uploaded unchanged and may identify the patient"))
+		}
+	}
 
-func Scan(client *api.Client, folder string, group_id string, project_label string, related_acq bool, quiet, noTree bool, local bool) {
 	// check that user has permission to group
 	group_label, err := check_group_perms(client, group_id)
 	Check(err)
@@ -62,30 +161,116 @@ func Scan(client *api.Client, folder string, group_id string, project_label stri
 		project_label = project.Name
 	}
 
+	return group_label, project_label, subjects
+}
+
+// collect_sessions reads every DICOM file below folder and sorts them into sessions and acquisitions.
+// Each series is checked for completeness, then related series are grouped and split as set up by
+// setRelatedAcquisitions.
+func collect_sessions(folder string, workers int, quiet bool) (map[string]Session, error) {
 	sessions := make(map[string]Session)
 	fmt.Println("Collecting Files...")
-	all_files := make([]DicomFile, 0)
 
-	err = fp.Walk(folder, fileWalker(&all_files, quiet))
-	Check(err)
-	err = sort_dicoms(sessions, &all_files, related_acq)
+	// Headers are parsed in parallel and sorted as they arrive
+	files, errc := scanFiles(folder, workers)
+	stopProgress := scanProgress(quiet)
+	err := sort_dicoms(sessions, files)
+	stopProgress()
+	if err != nil {
+		// Drain the rest so the workers and the walk can finish
+		for range files {
+		}
+		<-errc
+		return nil, err
+	}
+	err = <-errc
+	if err != nil {
+		return nil, err
+	}
+
+	// Checked per series as sent, before related series are merged or split into parts that look incomplete
+	check_series(sessions)
+	if relating() {
+		relate_acquisitions(sessions)
+	}
+
+	prune_empty(sessions)
+	return sessions, nil
+}
+
+// reset_scan clears the counts and exclusions of a previous import, for processes that import more than once.
+func reset_scan() {
+	sessions_found, acquisitions_found = 0, 0
+	sessions_uploaded, acquisitions_uploaded = 0, 0
+	atomic.StoreInt64(&dicoms_found, 0)
+	atomic.StoreInt64(&files_skipped, 0)
+	atomic.StoreInt64(&files_scanned, 0)
+	exclusions = nil
+	others = nil
+	conflicted = map[string]bool{}
+}
+
+// replace panics with {return err}
+
+func Scan(client *api.Client, folder string, group_id string, project_label string, options *ScanOptions) {
+	quiet, noTree, local := options.Quiet, options.NoTree, options.Local
+	reportPath := options.ReportPath
+	defer close_archives()
+
+	group_label, project_label, subjects := prepare_scan(client, group_id, project_label, options)
+
+	sessions, err := collect_sessions(folder, options.Workers, quiet)
 	Check(err)
 
+	if subjects != nil {
+		unmapped := apply_subject_map(sessions, subjects, options.Unmapped)
+		if len(unmapped) > 0 {
+			printUnmapped(unmapped, options.Unmapped)
+			if options.Unmapped == UnmappedFail {
+				Fatal(1)
+			}
+		}
+	}
+
+	fmt.Println("Checking for existing series...")
+	Check(find_existing(client, group_id, project_label, sessions))
+
 	if !noTree {
 		printTree(sessions, group_label, project_label)
 	}
 
+	if options.RequireComplete {
+		printIncomplete(hold_incomplete(sessions))
+	}
+	attachments := plan_attachments(sessions)
+
 	// Save hierarchy if location flag set to valid directory
 	if local {
-		Check(save_hierarchy(client, sessions, group_label, project_label))
+		Check(save_hierarchy(sessions, group_label, project_label, quiet))
 	}
 
 	// Summary of what is to be uploaded
+	printOthers(quiet)
+	printExclusions()
 	whatever := "                     "
 	fmt.Println("This scan consists of:\n",
 		whatever, sessions_found, "sessions,\n",
 		whatever, acquisitions_found, "acquisitions,\n",
-		whatever, files_skipped, "files skipped\n")
+		whatever, count_existing(sessions), "acquisitions already in the project,\n",
+		whatever, len(attachments), "attachments,\n",
+		whatever, files_skipped, "files skipped,\n",
+		whatever, len(exclusions), "files excluded")
+	fmt.Println()
+
+	if conflictPolicy == ConflictFail && len(exclusions) > 0 {
+		fmt.Println("Stopping: files were excluded and --on-conflict is", ConflictFail)
+		if reportPath != "" {
+			Check(importReport.Save(reportPath))
+			fmt.Println("Wrote import report to", reportPath)
+		}
+		Fatal(1)
+	}
+
 	proceed := prompt.Confirm("Confirm upload? (yes/no)")
 	fmt.Println()
 	if !proceed {
@@ -95,51 +280,54 @@ func Scan(client *api.Client, folder string, group_id string, project_label stri
 	fmt.Println("Beginning upload.")
 	fmt.Println()
 
-	err = upload_dicoms(sessions, client, related_acq, group_id, project_label, quiet)
-	Check(err)
+	upload_dicoms(sessions, client, group_id, project_label, quiet, options.Jobs, options.Retries)
+	upload_attachments(attachments, client, group_id, project_label, quiet, options.Retries)
+
+	if deidProfile != nil {
+		deidProfile.PrintSummary(os.Stdout)
+	}
+
+	if reportPath != "" {
+		Check(importReport.Save(reportPath))
+		fmt.Println("Wrote import report to", reportPath)
+	}
+
+	exitCode := importReport.ExitCode()
+	if exitCode != ExitSuccess {
+		fmt.Println("Import finished with", len(importReport.Errors), "errors:")
+		for _, x := range importReport.Errors {
+			fmt.Println("  " + x)
+		}
+		Fatal(exitCode)
+	}
 }
 
-func copy_file(file_path string, copy_path string) error {
-	file, err := os.Open(file_path)
+func copy_file(source DicomFile, copy_path string) error {
+	file, err := open_source(source)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 	copy, err := os.Create(copy_path)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(copy, file)
+	err = copy_dicom(copy, file)
 	if err != nil {
+		copy.Close()
 		return err
 	}
-	file.Close()
-	copy.Close()
-	return nil
+	return copy.Close()
 }
 
-func save_hierarchy(client *api.Client, sessions map[string]Session, group_label string, project_label string) error {
+// save_hierarchy copies the sorted files below group/project in the working directory
+func save_hierarchy(sessions map[string]Session, group_label string, project_label string, quiet bool) error {
 	fmt.Println("Creating tree locally...")
-	var perm os.FileMode = 0777
 
-	base_path := group_label + "/" + project_label
-	err := os.MkdirAll(base_path, perm)
-	if err != nil {
-		return err
-	}
-	for _, session := range sessions {
-		path := base_path + "/" + session.SdkSession.Subject.Code + "/" + session.SdkSession.Name
-		for _, acq := range session.Acquisitions {
-			err = os.MkdirAll(path+"/"+acq.SdkAcquisition.Name, perm)
-			if err != nil {
-				return err
-			}
-			for sop, file := range acq.Files {
-				err = copy_file(file.Path, path+"/"+acq.SdkAcquisition.Name+"/"+sop)
-				if err != nil {
-					return err
-				}
-			}
-		}
+	base := fp.Join(sanitize_name(group_label), sanitize_name(project_label))
+	failed := write_hierarchy(sessions, base, SortCopy, quiet)
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be saved locally", failed)
 	}
 	return nil
 }
@@ -148,9 +336,24 @@ func printTree(sessions map[string]Session, group_label string, project_label st
 	fmt.Printf("\nDerived hierarchy\n")
 	fmt.Printf("%s\n\t%s\n", group_label, project_label)
 	for _, session := range sessions {
-		fmt.Printf("\t\t%s >>> %s\n", session.SdkSession.Name, session.SdkSession.Subject.Code)
+		existing := ""
+		if session.ExistingId != "" {
+			existing = " (existing)"
+		}
+		fmt.Printf("\t\t%s >>> %s%s\n", session.SdkSession.Name, session.SdkSession.Subject.Code, existing)
 		for _, acq := range session.Acquisitions {
-			fmt.Printf("\t\t\t%s\n", acq.SdkAcquisition.Name)
+			related := ""
+			if len(acq.Related) > 1 {
+				related = fmt.Sprintf(" (%d series)", len(acq.Related))
+			}
+			if acq.Existing != nil {
+				fmt.Printf("\t\t\t%s%s %s\n", acq.SdkAcquisition.Name, related, existing_note(acq))
+			} else {
+				fmt.Printf("\t\t\t%s%s\n", acq.SdkAcquisition.Name, related)
+			}
+			for _, warning := range acq.Warnings {
+				fmt.Printf("\t\t\t\tWarning: %s\n", warning)
+			}
 		}
 	}
 }
@@ -209,146 +412,126 @@ func determine_name(file DicomFile, level string) (string, error) {
 }
 
 // simple function to deal with only needing values of dicom elements
+// values are de-identified, so labels and uids match the uploaded files
 func extract_value(file DicomFile, lookup_string string) (string, error) {
 	el, err := file.FindElementByName(lookup_string)
 	if err != nil {
 		return "", err
 	}
 	s, err := el.GetString()
-	return s, err
+	return deidProfile.Value(lookup_string, s), err
+}
+
+// copies a dicom file, de-identifying it on the way if a profile is set
+func copy_dicom(w io.Writer, r io.Reader) error {
+	if deidProfile != nil {
+		return deidProfile.Apply(w, r)
+	}
+	_, err := io.Copy(w, r)
+	return err
 }
 
 // Found online at https://golangcode.com/create-zip-files-in-go/
 func ZipFiles(newfile io.Writer, acq *Acquisition) error {
-	zipWriter := zip.NewWriter(newfile)
-	defer zipWriter.Close()
+	zipWriter := new_zip_writer(newfile)
 
-	// Add files to zip
-	for SOPInstanceUID, file := range acq.Files {
-		zipfile, err := os.Open(file.Path)
-		if err != nil {
-			return err
-		}
-
-		// Get the file information
-		info, err := zipfile.Stat()
-		if err != nil {
-			return err
-		}
-
-		header, err := zip.FileInfoHeader(info)
+	// Add files to zip, in InstanceNumber order
+	for _, entry := range zip_entries(acq) {
+		err := add_zip_entry(zipWriter, entry)
 		if err != nil {
+			// The zip is left unfinished; the caller closes the pipe with this error so the upload is aborted
 			return err
 		}
+	}
+	return zipWriter.Close()
+}
 
-		// By default, name the file: {Modality}.{SOPInstanceUID}.dcm
-		if len(SOPInstanceUID) > 0 {
-			Modality, _ := extract_value(file, "Modality")
-			if len(Modality) == 0 {
-				Modality = "NA"
-			}
-			header.Name = fmt.Sprintf("%s.%s.dcm", Modality, SOPInstanceUID)
-		}
+// add_zip_entry copies one file into the zip, closing the source whether or not the copy succeeds
+func add_zip_entry(zipWriter *zip.Writer, entry *zipEntry) error {
+	file := entry.file
+	zipfile, err := open_source(file)
+	if err != nil {
+		return err
+	}
+	defer zipfile.Close()
 
-		// Change to deflate to gain better compression
-		// see http://golang.org/pkg/archive/zip/#pkg-constants
-		header.Method = zip.Deflate
+	header := &zip.FileHeader{Name: entry.name, Modified: zipEpoch, Method: zip_method(file)}
 
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(writer, zipfile)
-		if err != nil {
-			return err
-		}
-		zipfile.Close()
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	err = copy_dicom(writer, zipfile)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file.Path, err)
 	}
 	return nil
 }
 
-// uploads dicoms as zips at the acquisition level, uses upload/uid endpoint
-func upload_dicoms(sessions map[string]Session, c *api.Client, related_acq bool, group_id string, project_label string, quiet bool) error {
-
-	for _, session := range sessions {
-		sdk_session := session.SdkSession
-		sessions_uploaded++
-
-		for _, acquisition := range session.Acquisitions {
-			sdk_acquisition := acquisition.SdkAcquisition
-			acquisitions_uploaded++
-			paths := make([]string, 0)
-			for _, file := range acquisition.Files {
-				paths = append(paths, file.Path)
-			}
-			file_name := strings.TrimRight(sdk_acquisition.Name, " ") + ".dcm.zip"
+// zips and uploads a single acquisition, returning the number of bytes sent
+func upload_acquisition(c *api.Client, sdk_session api.Session, acquisition *Acquisition, file_name string, group_id string, project_label string, quiet bool) (int64, error) {
+	sdk_acquisition := acquisition.SdkAcquisition
 
-			metadata := map[string]interface{}{
-				"group": map[string]interface{}{
-					"_id": group_id,
-				},
-				"project": map[string]interface{}{
-					"label": project_label,
-				},
-				"session": map[string]interface{}{
-					"uid":   sdk_session.Uid,
-					"label": sdk_session.Name,
-					"subject": map[string]interface{}{
-						"code": sdk_session.Subject.Code,
-					},
-				},
-				"acquisition": map[string]interface{}{
-					"uid":   sdk_acquisition.Uid,
-					"label": sdk_acquisition.Name,
-					"files": []interface{}{
-						map[string]interface{}{
-							"name": file_name,
-						},
-					},
+	metadata := map[string]interface{}{
+		"group": map[string]interface{}{
+			"_id": group_id,
+		},
+		"project": map[string]interface{}{
+			"label": project_label,
+		},
+		"session": map[string]interface{}{
+			"uid":   sdk_session.Uid,
+			"label": sdk_session.Name,
+			"subject": map[string]interface{}{
+				"code": sdk_session.Subject.Code,
+			},
+		},
+		"acquisition": map[string]interface{}{
+			"uid":   sdk_acquisition.Uid,
+			"label": sdk_acquisition.Name,
+			"files": []interface{}{
+				map[string]interface{}{
+					"name": file_name,
 				},
-			}
-
-			metadata_bytes, err := json.Marshal(metadata)
-			if err != nil {
-				return err
-			}
-			uploadfile, newfile := io.Pipe()
-			go func() {
-				defer newfile.Close()
-				err = ZipFiles(newfile, acquisition)
-				if err != nil {
-					fmt.Println("Failed to compress files for acqusition " + sdk_acquisition.Name)
-					Check(err)
-				}
-			}()
-			src := &api.UploadSource{Name: file_name, Reader: uploadfile}
-			prog, errc := c.UploadSimple("upload/uid", metadata_bytes, src)
-
-			for update := range prog {
-				if !quiet {
-					fmt.Println("  Uploaded", humanize.Bytes(uint64(update)))
-				}
-			}
-
-			err = <-errc
-			if err != nil {
-				return err
-			}
+			},
+		},
+	}
 
-			fmt.Println("Uploaded", file_name)
+	metadata_bytes, err := json.Marshal(metadata)
+	if err != nil {
+		return 0, err
+	}
+	uploadfile, newfile := io.Pipe()
+	go func() {
+		// Closing with the zip error aborts the upload instead of sending a truncated file
+		newfile.CloseWithError(ZipFiles(newfile, acquisition))
+	}()
+	src := &api.UploadSource{Name: file_name, Reader: uploadfile}
+	prog, errc := c.UploadSimple("upload/uid", metadata_bytes, src)
+
+	var written int64
+	for update := range prog {
+		written = int64(update)
+		if !quiet {
+			fmt.Println("  Uploaded", humanize.Bytes(uint64(update)), "of", file_name)
 		}
 	}
-	fmt.Println("\nUpload Complete\n")
-	return nil
+
+	err = <-errc
+	// Unblocks the zip writer if the upload stopped reading early
+	uploadfile.Close()
+	return written, err
 }
 
 // sorts dicoms by study instance uid and series instance uid (session, acquisition)
-func sort_dicoms(sessions map[string]Session, files *[]DicomFile, related_acq bool) error {
-	fmt.Println("\nSorting ...")
-
-	for _, file := range *files {
-		session_name, nerr := determine_name(file, "Study")
-		acquisition_name, nerr := determine_name(file, "Series")
+// files are sorted as they are received, until the channel is closed
+func sort_dicoms(sessions map[string]Session, files <-chan DicomFile) error {
+	for file := range files {
+		session_name, serr := session_label(file)
+		acquisition_name, nerr := acquisition_label(file)
+		if serr != nil {
+			nerr = serr
+		}
 		StudyInstanceUID, _ := extract_value(file, "StudyInstanceUID")
 		SeriesInstanceUID, _ := extract_value(file, "SeriesInstanceUID")
 		SOPInstanceUID, _ := extract_value(file, "SOPInstanceUID")
@@ -356,96 +539,70 @@ func sort_dicoms(sessions map[string]Session, files *[]DicomFile, related_acq bo
 		StudyInstanceUID = strings.Replace(StudyInstanceUID, ".", "", -1)
 		SeriesInstanceUID = strings.Replace(SeriesInstanceUID, ".", "", -1)
 
-		if nerr == nil {
-			if session, ok := sessions[StudyInstanceUID]; ok {
-				// Session and Acqusition already in the map
-				if _, ok := session.Acquisitions[SeriesInstanceUID]; ok {
-					if existing_file, exists := session.Acquisitions[SeriesInstanceUID].Files[SOPInstanceUID]; exists {
-						// Check if it's safe to ignore this file
-						cmp := equalfile.New(nil, equalfile.Options{})
-						equal, err := cmp.CompareFile(existing_file.Path, file.Path)
-						if err != nil {
-							fmt.Printf("Error reading file: %v\n", err)
-							Fatal(1)
-						}
-						if !equal {
-							fmt.Printf("File \"%s\" and \"%s\" conflict!\n", existing_file.Path, file.Path)
-							fmt.Printf("Both files have the same IDs, but contents differ!\n")
-							Fatal(1)
-						}
-					} else {
-						session.Acquisitions[SeriesInstanceUID].Files[SOPInstanceUID] = file
-						dicoms_found++
-					}
-					// Session in the map but no acquisition yet
-				} else {
-					sdk_acquisition := api.Acquisition{Name: acquisition_name, Uid: SeriesInstanceUID}
-					new_acq := Acquisition{Files: make(map[string]DicomFile, 0), SdkAcquisition: sdk_acquisition}
-					session.Acquisitions[SeriesInstanceUID] = &new_acq
-					session.Acquisitions[SeriesInstanceUID].Files[SOPInstanceUID] = file
+		if nerr != nil {
+			exclude(file.Path, SOPInstanceUID, "could not determine session or acquisition label: "+nerr.Error(), true)
+			continue
+		}
+		if conflicted[SOPInstanceUID] {
+			exclude(file.Path, SOPInstanceUID, "same SOPInstanceUID as other files whose contents differ", false)
+			continue
+		}
 
-					acquisitions_found++
-					dicoms_found++
+		if session, ok := sessions[StudyInstanceUID]; ok {
+			// Session and Acqusition already in the map
+			if acq, ok := session.Acquisitions[SeriesInstanceUID]; ok {
+				if existing_file, exists := acq.Files[SOPInstanceUID]; exists {
+					resolve_conflict(acq, SOPInstanceUID, existing_file, file)
+				} else {
+					acq.Files[SOPInstanceUID] = file
+					atomic.AddInt64(&dicoms_found, 1)
 				}
-				// Neither Session nor Acquisition is in the map
+				// Session in the map but no acquisition yet
 			} else {
-				subject_code, err := extract_value(file, "PatientID")
-				if err != nil {
-					fmt.Println("No subject code for session", session_name)
-				}
-				// Create Session and Subject
-				sdk_subject := api.Subject{Code: subject_code}
-				sdk_session := api.Session{Subject: &sdk_subject, Name: session_name, Uid: StudyInstanceUID}
-				sess := Session{SdkSession: sdk_session, Acquisitions: make(map[string]*Acquisition, 0)}
-
-				// Create Acquisition
 				sdk_acquisition := api.Acquisition{Name: acquisition_name, Uid: SeriesInstanceUID}
 				new_acq := Acquisition{Files: make(map[string]DicomFile, 0), SdkAcquisition: sdk_acquisition}
-				new_acq.Files[SOPInstanceUID] = file
-				sess.Acquisitions[SeriesInstanceUID] = &new_acq
-				sessions[StudyInstanceUID] = sess
+				session.Acquisitions[SeriesInstanceUID] = &new_acq
+				session.Acquisitions[SeriesInstanceUID].Files[SOPInstanceUID] = file
 
-				sessions_found++
 				acquisitions_found++
-				dicoms_found++
+				atomic.AddInt64(&dicoms_found, 1)
+			}
+			// Neither Session nor Acquisition is in the map
+		} else {
+			subject_code, err := subject_label(file)
+			if err != nil && deidProfile != nil {
+				exclude(file.Path, SOPInstanceUID, "no subject code while de-identifying: "+err.Error(), true)
+				continue
+			} else if err != nil {
+				fmt.Println("No subject code for session", session_name)
 			}
+			// Create Session and Subject
+			sdk_subject := api.Subject{Code: subject_code}
+			sdk_session := api.Session{Subject: &sdk_subject, Name: session_name, Uid: StudyInstanceUID}
+			sess := Session{SdkSession: sdk_session, Acquisitions: make(map[string]*Acquisition, 0), PatientID: patient_id(file)}
+
+			// Create Acquisition
+			sdk_acquisition := api.Acquisition{Name: acquisition_name, Uid: SeriesInstanceUID}
+			new_acq := Acquisition{Files: make(map[string]DicomFile, 0), SdkAcquisition: sdk_acquisition}
+			new_acq.Files[SOPInstanceUID] = file
+			sess.Acquisitions[SeriesInstanceUID] = &new_acq
+			sessions[StudyInstanceUID] = sess
+
+			sessions_found++
+			acquisitions_found++
+			atomic.AddInt64(&dicoms_found, 1)
 		}
 	}
-	fmt.Println("Sorting Complete\n")
 	return nil
 }
 
-func fileWalker(files *[]DicomFile, quiet bool) func(string, os.FileInfo, error) error {
-	return func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// don't parse nested directories
-		if info.IsDir() && !quiet {
-			fmt.Println("\tFrom", path)
-		} else if !info.IsDir() {
-			file, err := processFile(path)
-			if err != nil {
-				if err.Error() == "Keyword 'DICM' not found in the header" || err.Error() == "Skip: requested 128, available 0" {
-					// not a DICOM file
-					files_skipped++
-					return nil
-				} else {
-					Check(err)
-					return err
-				}
-			}
-			*files = append(*files, file)
-		}
-		return err
-	}
+// tag_before reports whether a comes before b in a data set
+func tag_before(a, b tag.Tag) bool {
+	return a.Group < b.Group || (a.Group == b.Group && a.Element < b.Element)
 }
 
-func processFile(path string) (DicomFile, error) {
-	var err error
-	// tags = make([]string,0)
-	di := &DicomFile{}
+// read_options limits header parsing to the tags the import uses
+func read_options() dicom.ReadOptions {
 	tagList := []tag.Tag{
 		tag.SeriesInstanceUID,
 		tag.StudyInstanceUID,
@@ -455,11 +612,30 @@ func processFile(path string) (DicomFile, error) {
 		tag.SeriesTime,
 		tag.StudyDescription,
 		tag.SeriesDescription,
+		tag.SeriesNumber,
 		tag.PatientID,
 		tag.SOPInstanceUID,
 		tag.Modality,
+		tag.InstanceNumber,
+		tag.TransferSyntaxUID,
+	}
+
+	// Label templates and split tags may reference tags past where the header is normally cut off
+	stopTag := tag.StackID
+	for _, t := range append(template_tags(), related_tags()...) {
+		tagList = append(tagList, t)
+		if !tag_before(t, stopTag) {
+			stopTag = tag.PixelData
+		}
 	}
-	di.DataSet, err = dicom.ReadDataSetFromFile(path, dicom.ReadOptions{DropPixelData: true, StopAtTag: &tag.StackID, ReturnTags: tagList})
-	di.Path = path
-	return *di, err
+
+	// The completeness check only needs the image description that starts group 0028, not the rest of the header
+	for _, t := range completeness_tags() {
+		tagList = append(tagList, t)
+		if !tag_before(t, stopTag) && tag_before(stopTag, completenessStop) {
+			stopTag = completenessStop
+		}
+	}
+
+	return dicom.ReadOptions{DropPixelData: true, StopAtTag: &stopTag, ReturnTags: tagList}
 }
@@ -0,0 +1,245 @@
+package dicom
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	fp "path/filepath"
+	"time"
+
+	. "flywheel.io/fw/util"
+)
+
+// Presentation context ids are odd, so an association can propose at most 128
+const maxContexts = 128
+
+// Send stores DICOM files on a C-STORE SCP, such as fw dicom listen, over a single association.
+func Send(address string, calledAE string, callingAE string, paths []string) {
+	sent, total, err := send_files(address, calledAE, callingAE, paths)
+	Check(err)
+
+	fmt.Println("Sent", sent, "of", total, "files to", calledAE, "at", address)
+	if sent < total {
+		Fatal(1)
+	}
+}
+
+// Echo checks that a DICOM receiver accepts associations, with a C-ECHO.
+func Echo(address string, calledAE string, callingAE string) {
+	Check(echo_scp(address, calledAE, callingAE))
+	fmt.Println("Echo to", calledAE, "at", address, "succeeded")
+}
+
+// association is an association opened with an SCP.
+type association struct {
+	conn     net.Conn
+	d        *dulConn
+	address  string
+	accepted map[byte]bool
+}
+
+func associate(address string, calledAE string, callingAE string, contexts []*presentationContext) (*association, error) {
+	conn, err := net.DialTimeout("tcp", address, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	err = write_pdu(conn, pduAssociateRQ, encode_associate(pduAssociateRQ, &associateParams{
+		calledAE:  calledAE,
+		callingAE: callingAE,
+		contexts:  contexts,
+	}))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	d := new_dul_conn(conn)
+	kind, pdu, err := d.read_pdu()
+	if err == nil {
+		switch kind {
+		case pduAssociateAC:
+		case pduAssociateRJ:
+			err = errors.New("Association rejected by " + address)
+		default:
+			err = fmt.Errorf("Unexpected reply to association request: PDU type %d", kind)
+		}
+	}
+	var params *associateParams
+	if err == nil {
+		params, err = parse_associate(pdu)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.maxSend = params.maxLength
+
+	a := &association{conn: conn, d: d, address: address, accepted: map[byte]bool{}}
+	for _, pc := range params.contexts {
+		a.accepted[pc.id] = pc.result == 0
+	}
+	return a, nil
+}
+
+// release ends the association and closes the connection.
+func (a *association) release() {
+	defer a.conn.Close()
+
+	err := write_pdu(a.conn, pduReleaseRQ, make([]byte, 4))
+	if err == nil {
+		var kind byte
+		kind, _, err = a.d.read_pdu()
+		if err == nil && kind != pduReleaseRP {
+			err = fmt.Errorf("PDU type %d", kind)
+		}
+	}
+	if err != nil {
+		fmt.Println("Association was not released cleanly")
+	}
+}
+
+func echo_scp(address string, calledAE string, callingAE string) error {
+	a, err := associate(address, calledAE, callingAE, []*presentationContext{{
+		id:               1,
+		abstractSyntax:   verificationUID,
+		transferSyntaxes: []string{transferImplicitLittle},
+	}})
+	if err != nil {
+		return err
+	}
+	defer a.release()
+
+	if !a.accepted[1] {
+		return errors.New("Verification was not accepted by " + address)
+	}
+
+	err = a.d.send_message(1, commandSet{
+		elementAffectedSOPClassUID: ui(verificationUID),
+		elementCommandField:        us(commandEchoRQ),
+		elementMessageID:           us(1),
+		elementCommandDataSetType:  us(noDataSet),
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	msg, err := a.d.next_message()
+	if err != nil {
+		return err
+	}
+	if status := msg.command.uint16(elementStatus); status != statusSuccess {
+		return fmt.Errorf("echo failed with status 0x%04X", status)
+	}
+	return nil
+}
+
+// send_files stores the DICOM files found in paths over one association. Returns how many were sent out of how
+// many were found; files that fail are reported and skipped.
+func send_files(address string, calledAE string, callingAE string, paths []string) (int, int, error) {
+	var files []string
+	var contexts []*presentationContext
+	contextIds := map[string]byte{}
+	fileContexts := map[string]string{}
+
+	for _, path := range paths {
+		err := fp.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Println("Could not read", path+":", err)
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			file, err := read_part10(path)
+			if err != nil {
+				fmt.Println("Skipping", path+":", err)
+				return nil
+			}
+
+			key := file.sopClass + "\x00" + file.transferSyntax
+			if _, ok := contextIds[key]; !ok {
+				if len(contexts) == maxContexts {
+					return errors.New("Files use more than 128 combinations of SOP class and transfer syntax; send them in smaller batches")
+				}
+				id := byte(2*len(contexts) + 1)
+				contextIds[key] = id
+				contexts = append(contexts, &presentationContext{
+					id:               id,
+					abstractSyntax:   file.sopClass,
+					transferSyntaxes: []string{file.transferSyntax},
+				})
+			}
+
+			files = append(files, path)
+			fileContexts[path] = key
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if len(files) == 0 {
+		return 0, 0, errors.New("No DICOM files to send")
+	}
+
+	a, err := associate(address, calledAE, callingAE, contexts)
+	if err != nil {
+		return 0, len(files), err
+	}
+
+	sent := 0
+	for i, path := range files {
+		err = send_file(a.d, path, contextIds[fileContexts[path]], a.accepted, uint16(i+1))
+		if err == errAborted {
+			a.conn.Close()
+			return sent, len(files), errors.New("Association aborted by " + address)
+		} else if err != nil {
+			fmt.Println("Failed to send", path+":", err)
+			continue
+		}
+		sent++
+	}
+
+	a.release()
+	return sent, len(files), nil
+}
+
+// send_file stores one file and waits for its response.
+func send_file(d *dulConn, path string, context byte, accepted map[byte]bool, messageId uint16) error {
+	if !accepted[context] {
+		return errors.New("its SOP class and transfer syntax were not accepted")
+	}
+
+	file, err := read_part10(path)
+	if err != nil {
+		return err
+	}
+
+	err = d.send_message(context, commandSet{
+		elementAffectedSOPClassUID:    ui(file.sopClass),
+		elementCommandField:           us(commandStoreRQ),
+		elementMessageID:              us(messageId),
+		elementPriority:               us(0),
+		elementCommandDataSetType:     us(0),
+		elementAffectedSOPInstanceUID: ui(file.sopInstance),
+	}, file.data)
+	if err != nil {
+		return err
+	}
+
+	msg, err := d.next_message()
+	if err != nil {
+		return err
+	}
+
+	// Warning statuses (0xBxxx, 0x0107 and 0x0116) still mean the instance was stored
+	status := msg.command.uint16(elementStatus)
+	if status != statusSuccess && status&0xF000 != 0xB000 && status != 0x0107 && status != 0x0116 {
+		return fmt.Errorf("store failed with status 0x%04X", status)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package dicom
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	. "flywheel.io/fw/util"
+)
+
+// Ways of placing sorted files in the output folder.
+const (
+	SortCopy     = "copy"
+	SortHardlink = "hardlink"
+	SortSymlink  = "symlink"
+)
+
+// SortOptions configures an offline DICOM sort.
+type SortOptions struct {
+	Mode    string
+	Quiet   bool
+	Workers int
+
+	// Same meaning as for ScanOptions
+	OnConflict       string
+	SessionLabel     string
+	AcquisitionLabel string
+	Subject          string
+	RelatedAcq       bool
+	RelatedSeries    []string
+	SplitBy          []string
+}
+
+// SeriesSummary describes one sorted series; it is written next to its files as series.json.
+type SeriesSummary struct {
+	Subject           string   `json:"subject"`
+	Session           string   `json:"session"`
+	Acquisition       string   `json:"acquisition"`
+	StudyInstanceUID  string   `json:"study_instance_uid"`
+	SeriesInstanceUID string   `json:"series_instance_uid"`
+	SeriesNumber      string   `json:"series_number,omitempty"`
+	SeriesDescription string   `json:"series_description,omitempty"`
+	Modality          string   `json:"modality,omitempty"`
+	StudyDate         string   `json:"study_date,omitempty"`
+	SeriesDate        string   `json:"series_date,omitempty"`
+	Instances         int      `json:"instances"`
+	Files             []string `json:"files"`
+	Warnings          []string `json:"warnings,omitempty"`
+}
+
+// Sort arranges the DICOM files in folder into subject/session/acquisition folders under out, without a Flywheel login.
+func Sort(folder string, out string, options *SortOptions) {
+	importReport = NewImportReport()
+	defer close_archives()
+
+	switch options.Mode {
+	case SortCopy, SortHardlink, SortSymlink:
+	default:
+		Check(errors.New("Unknown sort mode " + options.Mode + "; use " + SortCopy + ", " + SortHardlink + " or " + SortSymlink))
+	}
+	Check(setConflictPolicy(options.OnConflict))
+	Check(setLabelTemplates(options.SessionLabel, options.AcquisitionLabel, options.Subject))
+	Check(setRelatedAcquisitions(options.RelatedAcq, options.RelatedSeries, options.SplitBy))
+
+	sessions, err := collect_sessions(folder, options.Workers, options.Quiet)
+	Check(err)
+
+	printOthers(options.Quiet)
+	printExclusions()
+	if conflictPolicy == ConflictFail && len(exclusions) > 0 {
+		fmt.Println("Stopping: files were excluded and --on-conflict is", ConflictFail)
+		Fatal(1)
+	}
+
+	failed := write_hierarchy(sessions, out, options.Mode, options.Quiet)
+
+	fmt.Println("Sorted", dicoms_found, "files into", acquisitions_found, "series in", sessions_found, "sessions under", out)
+	if failed > 0 {
+		fmt.Println(failed, "files could not be written")
+		Fatal(1)
+	}
+}
+
+// uniqueNames hands out sanitized names within one folder, so distinct containers never share a folder.
+// Names are compared case-insensitively, for the sake of case-insensitive file systems.
+type uniqueNames struct {
+	taken map[string]string
+}
+
+func newUniqueNames() *uniqueNames {
+	return &uniqueNames{taken: map[string]string{}}
+}
+
+// name returns the folder name for key, suffixing _2, _3... when a different key already uses the sanitized label.
+func (u *uniqueNames) name(key, label string) string {
+	base := sanitize_name(label)
+	name := base
+
+	for i := 2; ; i++ {
+		owner, ok := u.taken[strings.ToLower(name)]
+		if !ok {
+			u.taken[strings.ToLower(name)] = key
+			return name
+		} else if owner == key {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sanitize_name makes a label safe to use as a file or folder name on any platform.
+func sanitize_name(label string) string {
+	name := unsafeNameChars.ReplaceAllString(strings.TrimSpace(label), "_")
+	name = strings.Trim(name, "._")
+	if name == "" {
+		return "unnamed"
+	}
+	return name
+}
+
+// write_hierarchy places every sorted file under base as subject/session/acquisition/<SOPInstanceUID>.dcm,
+// with a series.json in each acquisition folder. Returns the number of files that could not be written.
+func write_hierarchy(sessions map[string]Session, base string, mode string, quiet bool) int {
+	failed := 0
+	subjects := newUniqueNames()
+	sessionNames := map[string]*uniqueNames{}
+
+	var study_uids []string
+	for study_uid := range sessions {
+		study_uids = append(study_uids, study_uid)
+	}
+	sort.Strings(study_uids)
+
+	for _, study_uid := range study_uids {
+		session := sessions[study_uid]
+		code := session.SdkSession.Subject.Code
+		if code == "" {
+			code = "unknown"
+		}
+
+		subject_dir := subjects.name(code, code)
+		if sessionNames[subject_dir] == nil {
+			sessionNames[subject_dir] = newUniqueNames()
+		}
+		session_dir := fp.Join(base, subject_dir, sessionNames[subject_dir].name(study_uid, session.SdkSession.Name))
+
+		acquisitions := newUniqueNames()
+		var series_uids []string
+		for series_uid := range session.Acquisitions {
+			series_uids = append(series_uids, series_uid)
+		}
+		sort.Strings(series_uids)
+
+		for _, series_uid := range series_uids {
+			acq := session.Acquisitions[series_uid]
+			acq_dir := fp.Join(session_dir, acquisitions.name(series_uid, acq.SdkAcquisition.Name))
+
+			err := os.MkdirAll(acq_dir, 0755)
+			if err != nil {
+				fmt.Println("Could not create", acq_dir+":", err)
+				failed += len(acq.Files)
+				continue
+			}
+			if !quiet {
+				fmt.Println("Writing", acq_dir)
+			}
+			for _, warning := range acq.Warnings {
+				fmt.Println("  Warning:", acq.SdkAcquisition.Name, warning)
+			}
+
+			names := newUniqueNames()
+			var sops []string
+			for sop := range acq.Files {
+				sops = append(sops, sop)
+			}
+			sort.Strings(sops)
+
+			summary := series_summary(session, acq, sops)
+			for _, sop := range sops {
+				file := acq.Files[sop]
+				name := names.name(sop, sop) + ".dcm"
+
+				err = place_file(file, fp.Join(acq_dir, name), mode)
+				if err != nil {
+					fmt.Println("Could not write", file.Path+":", err)
+					failed++
+					continue
+				}
+				summary.Files = append(summary.Files, name)
+			}
+			summary.Instances = len(summary.Files)
+
+			err = ioutil.WriteFile(fp.Join(acq_dir, "series.json"), FormatBytes(summary), 0644)
+			if err != nil {
+				fmt.Println("Could not write series summary in", acq_dir+":", err)
+				failed++
+			}
+		}
+	}
+
+	return failed
+}
+
+// place_file copies or links a sorted file into place, replacing what a previous sort left there.
+// Archive members, and files that are de-identified on the way, can only be copied.
+func place_file(file DicomFile, target string, mode string) error {
+	// Removing first keeps a copy from writing through a link left by an earlier sort
+	err := os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if mode == SortCopy || file.Archive != "" || deidProfile != nil {
+		return copy_file(file, target)
+	}
+
+	if mode == SortHardlink {
+		return os.Link(file.Path, target)
+	}
+
+	source, err := fp.Abs(file.Path)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(source, target)
+}
+
+// series_summary collects the identifying values of a series from its first file.
+func series_summary(session Session, acq *Acquisition, sops []string) *SeriesSummary {
+	summary := &SeriesSummary{
+		Subject:     session.SdkSession.Subject.Code,
+		Session:     session.SdkSession.Name,
+		Acquisition: acq.SdkAcquisition.Name,
+		Files:       []string{},
+		Warnings:    acq.Warnings,
+	}
+	if len(sops) == 0 {
+		return summary
+	}
+
+	file := acq.Files[sops[0]]
+	value := func(name string) string {
+		s, _ := extract_value(file, name)
+		return strings.TrimSpace(s)
+	}
+
+	summary.StudyInstanceUID = value("StudyInstanceUID")
+	summary.SeriesInstanceUID = value("SeriesInstanceUID")
+	summary.SeriesNumber = value("SeriesNumber")
+	summary.SeriesDescription = value("SeriesDescription")
+	summary.Modality = value("Modality")
+	summary.StudyDate = value("StudyDate")
+	summary.SeriesDate = value("SeriesDate")
+	return summary
+}
@@ -0,0 +1,134 @@
+package dicom
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Policies for sessions whose PatientID has no entry in the subject map.
+const (
+	// Leave the session out of the upload
+	UnmappedSkip = "skip"
+
+	// Stop before uploading
+	UnmappedFail = "fail"
+
+	// Keep the subject code derived from the files
+	UnmappedKeep = "keep"
+)
+
+// LoadSubjectMap reads a two-column CSV of PatientID to subject code. A header row starting with PatientID is ignored.
+func LoadSubjectMap(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	result := map[string]string{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "PatientID") {
+			continue
+		}
+		if len(record) != 2 {
+			return nil, errors.New(path + " line " + strconv.Itoa(line) + ": expected PatientID,subject code")
+		}
+
+		id, code := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if id == "" || code == "" {
+			return nil, errors.New(path + " line " + strconv.Itoa(line) + ": PatientID and subject code must not be empty")
+		}
+		if existing, ok := result[id]; ok && existing != code {
+			return nil, errors.New(path + " line " + strconv.Itoa(line) + ": PatientID is mapped to both " + existing + " and " + code)
+		}
+		result[id] = code
+	}
+
+	return result, nil
+}
+
+// patient_id reads PatientID as stored in the file, before any de-identification.
+func patient_id(file DicomFile) string {
+	el, err := file.FindElementByName("PatientID")
+	if err != nil {
+		return ""
+	}
+	s, _ := el.GetString()
+	return strings.TrimSpace(s)
+}
+
+// apply_subject_map replaces every session's subject code with the mapped one.
+// Returns the PatientIDs that were not in the map; under the skip policy their sessions are dropped.
+func apply_subject_map(sessions map[string]Session, subjects map[string]string, unmapped string) []string {
+	missing := map[string]bool{}
+
+	for study_uid, session := range sessions {
+		if code, ok := subjects[session.PatientID]; ok {
+			session.SdkSession.Subject.Code = code
+			continue
+		}
+
+		missing[session.PatientID] = true
+
+		if unmapped == UnmappedSkip {
+			for _, acq := range session.Acquisitions {
+				for sop, file := range acq.Files {
+					exclude(file.Path, sop, "PatientID of session "+session.SdkSession.Name+" is not in the subject map", false)
+					atomic.AddInt64(&dicoms_found, -1)
+				}
+				acquisitions_found--
+			}
+			delete(sessions, study_uid)
+			sessions_found--
+		}
+	}
+
+	var result []string
+	for id := range missing {
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func checkUnmappedPolicy(unmapped string) error {
+	switch unmapped {
+	case UnmappedSkip, UnmappedFail, UnmappedKeep:
+		return nil
+	default:
+		return errors.New("Unknown unmapped policy " + unmapped + "; use " + UnmappedSkip + ", " + UnmappedFail + " or " + UnmappedKeep)
+	}
+}
+
+func printUnmapped(ids []string, unmapped string) {
+	switch unmapped {
+	case UnmappedSkip:
+		fmt.Println("Skipping sessions of", len(ids), "patients not in the subject map")
+	case UnmappedKeep:
+		fmt.Println("Keeping derived subject codes for", len(ids), "patients not in the subject map")
+	case UnmappedFail:
+		fmt.Println(len(ids), "PatientIDs are not in the subject map:")
+		for _, id := range ids {
+			fmt.Println("  " + id)
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,247 @@
+package dicom
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"flywheel.io/sdk/api"
+
+	. "flywheel.io/fw/util"
+)
+
+// Defaults for concurrent uploads
+const (
+	DefaultJobs    = 4
+	DefaultRetries = 3
+)
+
+// Delay before the first retry of an upload, doubled on every attempt after it
+var retryBackoff = 2 * time.Second
+
+const maxRetryBackoff = time.Minute
+
+// uploadJob is one acquisition zip to send, and how it went.
+type uploadJob struct {
+	session     api.Session
+	source      *Acquisition // As sorted, before leaving out the instances the server already has
+	acquisition *Acquisition
+	file_name   string
+
+	attempts int
+	written  int64
+	duration time.Duration
+	err      error
+}
+
+// uploads dicoms as zips at the acquisition level, uses upload/uid endpoint
+// acquisitions are uploaded concurrently and retried with backoff; failures are recorded in the
+// import report, and the rest of the study continues. Returns the acquisitions that failed.
+func upload_dicoms(sessions map[string]Session, c *api.Client, group_id string, project_label string, quiet bool, jobs int, retries int) []*Acquisition {
+	var queue []*uploadJob
+
+	// upload/uid creates a session that does not exist yet, so concurrent uploads into one new session could
+	// each create it. One acquisition of every new session goes first, then the rest.
+	var first, rest []*uploadJob
+	var failed []*Acquisition
+
+	for _, session := range sessions {
+		sdk_session := session.SdkSession
+		sessions_uploaded++
+
+		importReport.AddContainer(&ReportContainer{
+			Type:   "session",
+			Label:  sdk_session.Name,
+			Id:     session.ExistingId,
+			Status: ContainerByUid,
+		})
+
+		started := false
+		for _, acquisition := range session.Acquisitions {
+			sdk_acquisition := acquisition.SdkAcquisition
+			file_name := strings.TrimRight(sdk_acquisition.Name, " ") + ".dcm.zip"
+			upload := acquisition
+
+			// Series the project already has are skipped, appended to or replaced
+			if acquisition.Existing != nil && existingPolicy != ExistingReplace {
+				files := new_instances(acquisition)
+				if existingPolicy == ExistingAppend && files == nil {
+					// Uploading the whole series again would duplicate every instance the server has
+					reason := "cannot append, as the server's zip is not named by SOP Instance UID; use --existing replace"
+					fmt.Println("Not uploading", sdk_acquisition.Name+":", reason)
+					importReport.AddContainer(&ReportContainer{
+						Type:   "acquisition",
+						Label:  sdk_acquisition.Name,
+						Id:     acquisition.Existing.Id,
+						Status: ContainerFailed,
+						Error:  reason,
+					})
+					failed = append(failed, acquisition)
+					continue
+				}
+				if existingPolicy == ExistingSkip || len(files) == 0 {
+					if !quiet {
+						fmt.Println("Skipped existing", sdk_acquisition.Name)
+					}
+					importReport.AddContainer(&ReportContainer{
+						Type:   "acquisition",
+						Label:  sdk_acquisition.Name,
+						Id:     acquisition.Existing.Id,
+						Status: ContainerSkipped,
+					})
+					continue
+				}
+
+				// A new file name keeps the existing zip from being replaced
+				upload = &Acquisition{SdkAcquisition: sdk_acquisition, Files: files}
+				file_name = strings.TrimRight(sdk_acquisition.Name, " ") + "." + time.Now().Format("20060102150405") + ".dcm.zip"
+			}
+
+			acquisitions_uploaded++
+
+			id := ""
+			if acquisition.Existing != nil {
+				id = acquisition.Existing.Id
+			}
+			importReport.AddContainer(&ReportContainer{
+				Type:   "acquisition",
+				Label:  sdk_acquisition.Name,
+				Id:     id,
+				Status: ContainerByUid,
+			})
+
+			job := &uploadJob{session: sdk_session, source: acquisition, acquisition: upload, file_name: file_name}
+			if session.ExistingId == "" && !started {
+				first = append(first, job)
+				started = true
+			} else {
+				rest = append(rest, job)
+			}
+		}
+	}
+
+	run_uploads(first, c, group_id, project_label, quiet, jobs, retries)
+	run_uploads(rest, c, group_id, project_label, quiet, jobs, retries)
+	queue = append(first, rest...)
+
+	for _, job := range queue {
+		status := FileUploaded
+		errString := ""
+		if job.err != nil {
+			status = FileFailed
+			errString = job.err.Error()
+			failed = append(failed, job.source)
+		}
+
+		importReport.AddFile(&ReportFile{
+			Name:      job.file_name,
+			Container: job.session.Name + "/" + job.acquisition.SdkAcquisition.Name,
+			Status:    status,
+			Bytes:     job.written,
+			Duration:  job.duration.Seconds(),
+			Error:     errString,
+		})
+	}
+
+	fmt.Println("\nUpload Complete")
+	fmt.Println()
+	print_uploads(queue)
+	return failed
+}
+
+// run_uploads works through the queue with a bounded number of concurrent uploads.
+func run_uploads(queue []*uploadJob, c *api.Client, group_id string, project_label string, quiet bool, jobs int, retries int) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	pending := make(chan *uploadJob)
+	var wg sync.WaitGroup
+
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range pending {
+				upload_with_retries(job, c, group_id, project_label, quiet, retries)
+			}
+		}()
+	}
+
+	for _, job := range queue {
+		pending <- job
+	}
+	close(pending)
+	wg.Wait()
+}
+
+// upload_with_retries uploads one acquisition, trying again with exponential backoff when it fails.
+func upload_with_retries(job *uploadJob, c *api.Client, group_id string, project_label string, quiet bool, retries int) {
+	start := time.Now()
+
+	job.attempts, job.err = with_retries(job.file_name, retries, func() error {
+		var err error
+		job.written, err = upload_acquisition(c, job.session, job.acquisition, job.file_name, group_id, project_label, quiet)
+		return err
+	})
+
+	if job.err == nil {
+		fmt.Println("Uploaded", job.file_name)
+	} else {
+		fmt.Println("Failed to upload", job.file_name+":", job.err)
+	}
+
+	job.duration = time.Since(start)
+}
+
+// with_retries calls upload until it succeeds or has been retried retries times, backing off exponentially between
+// attempts. Returns how many attempts were made and the last error.
+func with_retries(name string, retries int, upload func() error) (int, error) {
+	backoff := retryBackoff
+
+	for attempts := 1; ; attempts++ {
+		err := upload()
+		if err == nil || attempts > retries {
+			return attempts, err
+		}
+
+		fmt.Println("Failed to upload", name+":", err, "- retrying in", backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// print_uploads shows a table of every acquisition upload, failures last.
+func print_uploads(queue []*uploadJob) {
+	if len(queue) == 0 {
+		return
+	}
+
+	sorted := make([]*uploadJob, len(queue))
+	copy(sorted, queue)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].err == nil && sorted[j].err != nil
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 2, 1, ' ', 0)
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", "Session", "Acquisition", "Status", "Attempts", "Size", "Error")
+	for _, job := range sorted {
+		status, errString := "uploaded", ""
+		if job.err != nil {
+			status, errString = "failed", job.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", job.session.Name, job.acquisition.SdkAcquisition.Name, status, job.attempts, humanize.Bytes(uint64(job.written)), errString)
+	}
+	w.Flush()
+	fmt.Println()
+}
@@ -0,0 +1,242 @@
+package dicom
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+
+	. "flywheel.io/fw/util"
+)
+
+// DefaultWorkers is the number of files whose headers are parsed at once when no count is given.
+var DefaultWorkers = runtime.NumCPU()
+
+var files_scanned int64 = 0
+
+// How often the live scan counter is redrawn
+const progressInterval = 250 * time.Millisecond
+
+// walkedFile is a path and its position in walk order, which decides first and last among conflicting files.
+type walkedFile struct {
+	path  string
+	order int
+	rel   string
+
+	// Set for archive members, which are read through open instead of from path
+	archive string
+	member  string
+	modTime time.Time
+	open    func() (io.ReadCloser, error)
+}
+
+// walkFiles sends every regular file below folder, or every member of an archive, in walk order.
+// Folders with a DICOMDIR only contribute the files it references. Unreadable paths are excluded
+// rather than stopping the walk.
+func walkFiles(folder string, paths chan<- walkedFile) error {
+	defer close(paths)
+
+	order := 0
+	if is_archive(folder) {
+		info, err := os.Stat(folder)
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			return walkArchive(folder, paths, &order)
+		}
+	}
+
+	indexes := map[string]dicomdirIndex{}
+
+	return fp.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The root itself must be readable
+			if path == folder {
+				return err
+			}
+			exclude(path, "", "could not read: "+err.Error(), true)
+			return nil
+		}
+
+		rel, err := fp.Rel(folder, path)
+		if err != nil {
+			return err
+		}
+		rel = fp.ToSlash(rel)
+
+		if info.IsDir() {
+			index, err := find_dicomdir(path)
+			if err != nil {
+				exclude(path, "", "could not read DICOMDIR: "+err.Error(), true)
+			} else if index != nil {
+				indexes[rel] = index
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || is_dicomdir(path) {
+			return nil
+		}
+		if !listed(indexes, rel) {
+			skip_unlisted(path)
+			return nil
+		}
+
+		if rel == "." {
+			rel = info.Name()
+		}
+		paths <- walkedFile{path: path, order: order, rel: rel, modTime: info.ModTime()}
+		order++
+		return nil
+	})
+}
+
+// parseFiles reads DICOM headers from paths until it is closed, sending each DICOM file found.
+// Files that are not DICOM are recorded as skipped, and files that fail to parse are excluded.
+func parseFiles(paths <-chan walkedFile, files chan<- DicomFile) {
+	for x := range paths {
+		path := x.path
+
+		file, err := read_walked(x, read_options())
+		file.order = x.order
+		file.rel = x.rel
+		file.modTime = x.modTime
+		atomic.AddInt64(&files_scanned, 1)
+
+		if err != nil {
+			kind, cerr := classify_other(x)
+			if cerr != nil {
+				exclude(path, "", "could not read: "+cerr.Error(), true)
+				continue
+			}
+			if kind != "" {
+				skip_other(x, kind)
+				importReport.AddFile(&ReportFile{
+					Name:   fp.Base(path),
+					Path:   path,
+					Status: FileSkipped,
+					Error:  "not a DICOM file: " + kind,
+				})
+				continue
+			}
+			exclude(path, "", "could not parse DICOM header: "+err.Error(), true)
+			continue
+		}
+
+		files <- file
+	}
+}
+
+// scanFiles walks folder and parses headers with a bounded pool of workers.
+// Parsed files are streamed on the returned channel, which is closed once every file has been read;
+// the walk's outcome is then sent on the error channel.
+func scanFiles(folder string, workers int) (<-chan DicomFile, <-chan error) {
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+
+	paths := make(chan walkedFile, workers*4)
+	files := make(chan DicomFile, workers*4)
+	errc := make(chan error, 1)
+
+	walkErrc := make(chan error, 1)
+	go func() {
+		walkErrc <- walkFiles(folder, paths)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			parseFiles(paths, files)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(files)
+		errc <- <-walkErrc
+	}()
+
+	return files, errc
+}
+
+// scanProgress redraws a single line counting scanned files until the returned function is called.
+func scanProgress(quiet bool) func() {
+	start := time.Now()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	print := func() {
+		scanned := atomic.LoadInt64(&files_scanned)
+		rate := float64(scanned) / time.Since(start).Seconds()
+		fmt.Printf("\r  %d files scanned (%.0f files/s), %d DICOMs found, %d files skipped ",
+			scanned, rate, atomic.LoadInt64(&dicoms_found), atomic.LoadInt64(&files_skipped))
+	}
+
+	go func() {
+		defer close(finished)
+		if quiet {
+			<-done
+			return
+		}
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				print()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+		print()
+		fmt.Println()
+	}
+}
+
+// read_walked reads the DICOM header of a loose file or an archive member.
+func read_walked(x walkedFile, options dicom.ReadOptions) (DicomFile, error) {
+	if x.open != nil {
+		return processMember(x, options)
+	}
+
+	file := DicomFile{Path: x.path}
+	var err error
+	file.DataSet, err = dicom.ReadDataSetFromFile(x.path, options)
+	return file, err
+}
+
+// processMember reads the DICOM header of an archive member.
+func processMember(x walkedFile, options dicom.ReadOptions) (DicomFile, error) {
+	file := DicomFile{Path: x.path, Archive: x.archive, Member: x.member}
+
+	reader, err := x.open()
+	if err != nil {
+		return file, err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return file, err
+	}
+
+	file.DataSet, err = dicom.ReadDataSetInBytes(data, options)
+	return file, err
+}
@@ -0,0 +1,183 @@
+package dicom
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How members of an acquisition zip are named.
+const (
+	// The file's path below the imported folder or archive
+	ZipNamingOriginal = "original"
+
+	// {Modality}.{SOPInstanceUID}.dcm
+	ZipNamingSop = "sop"
+
+	// {Modality}.{InstanceNumber}.dcm, zero-padded to four digits
+	ZipNamingInstance = "instance-number"
+)
+
+// How members of an acquisition zip are compressed. A number from 1 to 9 deflates at that level.
+const (
+	// Deflate, but store files whose transfer syntax is already compressed
+	CompressionAuto = "auto"
+
+	CompressionStore   = "store"
+	CompressionDeflate = "deflate"
+)
+
+var zipNaming = ZipNamingSop
+var zipCompression = CompressionAuto
+var zipLevel = flate.DefaultCompression
+
+// Every member gets the same modification time, so identical input makes identical zips
+var zipEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Transfer syntaxes whose pixel data is not already compressed
+var uncompressedSyntaxes = map[string]bool{
+	transferImplicitLittle: true,
+	transferExplicitLittle: true,
+	transferExplicitBig:    true,
+}
+
+func setZipOptions(naming, compression string) error {
+	switch naming {
+	case "":
+		zipNaming = ZipNamingSop
+	case ZipNamingOriginal, ZipNamingSop, ZipNamingInstance:
+		zipNaming = naming
+	default:
+		return errors.New("Unknown zip naming " + naming + "; use " + ZipNamingOriginal + ", " + ZipNamingSop + " or " + ZipNamingInstance)
+	}
+
+	zipLevel = flate.DefaultCompression
+	switch compression {
+	case "":
+		zipCompression = CompressionAuto
+	case CompressionAuto, CompressionStore, CompressionDeflate:
+		zipCompression = compression
+	default:
+		level, err := strconv.Atoi(compression)
+		if err != nil || level < 1 || level > 9 {
+			return errors.New("Unknown compression " + compression + "; use " + CompressionAuto + ", " + CompressionStore + ", " + CompressionDeflate + " or a level from 1 to 9")
+		}
+		zipCompression = CompressionDeflate
+		zipLevel = level
+	}
+	return nil
+}
+
+// new_zip_writer returns a zip writer that deflates at the configured level.
+func new_zip_writer(w io.Writer) *zip.Writer {
+	zipWriter := zip.NewWriter(w)
+	level := zipLevel
+	zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+	return zipWriter
+}
+
+// zipEntry is a file and the name it is stored under.
+type zipEntry struct {
+	sop  string
+	file DicomFile
+	name string
+}
+
+// zip_entries orders the files of an acquisition by InstanceNumber, then SOPInstanceUID, and names each one.
+func zip_entries(acq *Acquisition) []*zipEntry {
+	var entries []*zipEntry
+	for sop, file := range acq.Files {
+		entries = append(entries, &zipEntry{sop: sop, file: file})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, aok := instance_number(entries[i].file)
+		b, bok := instance_number(entries[j].file)
+		if aok != bok {
+			// Files without an InstanceNumber go last
+			return aok
+		}
+		if a != b {
+			return a < b
+		}
+		return entries[i].sop < entries[j].sop
+	})
+
+	// Names that would collide fall back to the SOPInstanceUID, which is unique within the acquisition
+	used := map[string]bool{}
+	for _, entry := range entries {
+		name := zip_member_name(entry.file, entry.sop)
+		if used[name] {
+			name = sop_member_name(entry.file, entry.sop)
+		}
+		used[name] = true
+		entry.name = name
+	}
+	return entries
+}
+
+func instance_number(file DicomFile) (int, bool) {
+	value, err := extract_value(file, "InstanceNumber")
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	return n, err == nil
+}
+
+func zip_member_name(file DicomFile, sop string) string {
+	switch zipNaming {
+	case ZipNamingOriginal:
+		// Cleaned so no member can point outside the folder it is extracted to
+		name := strings.TrimLeft(path.Clean("/"+file.rel), "/")
+		if name != "" && name != "." {
+			return name
+		}
+
+	case ZipNamingInstance:
+		if n, ok := instance_number(file); ok {
+			return fmt.Sprintf("%s.%04d.dcm", modality(file), n)
+		}
+	}
+	return sop_member_name(file, sop)
+}
+
+// sop_member_name is the default name: {Modality}.{SOPInstanceUID}.dcm
+func sop_member_name(file DicomFile, sop string) string {
+	if len(sop) == 0 {
+		return path.Base(file.rel)
+	}
+	return fmt.Sprintf("%s.%s.dcm", modality(file), sop)
+}
+
+func modality(file DicomFile) string {
+	Modality, _ := extract_value(file, "Modality")
+	if len(Modality) == 0 {
+		Modality = "NA"
+	}
+	return Modality
+}
+
+// zip_method stores files that are already compressed under the auto setting, and deflates the rest.
+func zip_method(file DicomFile) uint16 {
+	switch zipCompression {
+	case CompressionStore:
+		return zip.Store
+	case CompressionAuto:
+		syntax, err := extract_value(file, "TransferSyntaxUID")
+		syntax = strings.TrimRight(syntax, " \x00")
+		if err == nil && syntax != "" && !uncompressedSyntaxes[syntax] {
+			return zip.Store
+		}
+	}
+	return zip.Deflate
+}
@@ -54,6 +54,7 @@ var _ Container = &Project{}
 var _ Container = &Subject{}
 var _ Container = &Session{}
 var _ Container = &Acquisition{}
+var _ Container = &Analysis{}
 
 type User api.User
 
@@ -141,3 +142,19 @@ func (u *Acquisition) GetId() string {
 func (u *Acquisition) GetName() string {
 	return u.Name
 }
+
+// Analysis holds what is needed to download an analysis's files.
+type Analysis struct {
+	Id   string `json:"_id"`
+	Name string `json:"label"`
+}
+
+func (u *Analysis) GetType() string {
+	return "analysis"
+}
+func (u *Analysis) GetId() string {
+	return u.Id
+}
+func (u *Analysis) GetName() string {
+	return u.Name
+}
@@ -33,6 +33,8 @@ func Download(client *api.Client, filename string, parent interface{}, dest io.W
 		url = "sessions/" + parent.Id + "/files/" + filename
 	case *Acquisition:
 		url = "acquisitions/" + parent.Id + "/files/" + filename
+	case *Analysis:
+		url = "analyses/" + parent.Id + "/files/" + filename
 	case *ContainerTicketResponse:
 		url = "download?ticket=" + parent.Ticket
 	default:
@@ -0,0 +1,108 @@
+package ops
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/fatih/color"
+	prompt "github.com/segmentio/go-prompt"
+
+	"flywheel.io/sdk/api"
+
+	. "flywheel.io/fw/util"
+)
+
+// Outcomes of acting on a job
+const (
+	ActionDone    = "ok"
+	ActionSkipped = "skipped"
+	ActionFailed  = "failed"
+)
+
+// JobActionResult is printed as a line of JSON for every job cancelled or retried.
+type JobActionResult struct {
+	Id     string       `json:"id"`
+	Gear   string       `json:"gear,omitempty"`
+	State  api.JobState `json:"state,omitempty"`
+	Action string       `json:"action"`
+	Status string       `json:"status"`
+	NewId  string       `json:"new_id,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// selectJobs returns the jobs given by id, or when there are none, every job matching the filter.
+// Ids that cannot be found are returned as results that have already failed.
+func selectJobs(client *api.Client, ids []string, filter *JobFilter) ([]*JobRecord, []*JobActionResult, error) {
+	if len(ids) > 0 && !filter.IsEmpty() {
+		return nil, nil, errors.New("Give either job ids or filters, not both")
+	}
+
+	if len(ids) == 0 {
+		jobs, _, err := findJobs(client, filter, 0, 0)
+		return jobs, nil, err
+	}
+
+	var jobs []*JobRecord
+	var missing []*JobActionResult
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		job, err := getJobRecord(client, id)
+		if err != nil {
+			missing = append(missing, &JobActionResult{Id: id, Status: ActionFailed, Error: err.Error()})
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, missing, nil
+}
+
+// confirmJobs shows the jobs about to be acted on and asks to continue, unless yes is set.
+func confirmJobs(jobs []*JobRecord, verb string, yes bool) bool {
+	Println("Will " + verb + " " + strconv.Itoa(len(jobs)) + " jobs:")
+	printJobTable(color.Error, jobs)
+	Println()
+
+	if yes {
+		return true
+	}
+	proceed := prompt.Confirm("Continue? (yes/no)")
+	Println()
+	if !proceed {
+		Println("Canceled.")
+	}
+	return proceed
+}
+
+// applyToJobs runs act on each job, printing a JSON result per job to stdout and a summary to stderr.
+// Exits 1 if any job could not be acted on.
+func applyToJobs(jobs []*JobRecord, results []*JobActionResult, action string, act func(*JobRecord) *JobActionResult) {
+	for _, job := range jobs {
+		result := act(job)
+		result.Id, result.Gear, result.State, result.Action = job.Id, job.Gear(), job.State, action
+		results = append(results, result)
+	}
+
+	counts := map[string]int{}
+	for _, result := range results {
+		if result.Action == "" {
+			result.Action = action
+		}
+		counts[result.Status]++
+
+		raw, err := json.Marshal(result)
+		Check(err)
+		fmt.Println(string(raw))
+	}
+
+	Println(fmt.Sprintf("%d %s, %d skipped, %d failed.", counts[ActionDone], action, counts[ActionSkipped], counts[ActionFailed]))
+	if counts[ActionFailed] > 0 {
+		Fatal(1)
+	}
+}
@@ -0,0 +1,45 @@
+package ops
+
+import (
+	"flywheel.io/sdk/api"
+
+	. "flywheel.io/fw/util"
+)
+
+// CancelJobs cancels the jobs given by id, or every job matching the filter. When filtering without a state,
+// only pending and running jobs are selected, as only those can be cancelled.
+func CancelJobs(client *api.Client, ids []string, filter *JobFilter, yes bool) {
+	if len(ids) == 0 {
+		if filter.IsEmpty() {
+			FatalWithMessage("Give job ids, or filters such as --gear or --tag to select the jobs to cancel.")
+		}
+		if len(filter.States) == 0 {
+			filter.States = []string{string(api.Pending), string(api.Running)}
+		}
+	}
+
+	jobs, results, err := selectJobs(client, ids, filter)
+	Check(err)
+
+	if len(jobs) == 0 && len(results) == 0 {
+		Println("No jobs found.")
+		return
+	}
+	if len(jobs) > 0 && !confirmJobs(jobs, "cancel", yes) {
+		return
+	}
+
+	applyToJobs(jobs, results, "cancelled", func(job *JobRecord) *JobActionResult {
+		if isTerminal(job.State) {
+			return &JobActionResult{Status: ActionSkipped, Error: "job is already " + string(job.State)}
+		}
+
+		var aerr *api.Error
+		body := map[string]interface{}{"state": api.Cancelled}
+		_, err := client.New().Put("jobs/"+job.Id).BodyJSON(body).Receive(nil, &aerr)
+		if err = api.Coalesce(err, aerr); err != nil {
+			return &JobActionResult{Status: ActionFailed, Error: err.Error()}
+		}
+		return &JobActionResult{Status: ActionDone}
+	})
+}
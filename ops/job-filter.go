@@ -0,0 +1,366 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"flywheel.io/sdk/api"
+
+	"flywheel.io/fw/legacy"
+)
+
+// JobFilter selects jobs by their properties. Empty fields match every job.
+type JobFilter struct {
+	States []string
+
+	// Gear name, or name:version
+	Gear string
+
+	// Jobs must have every one of these tags
+	Tags []string
+
+	// Id of the user or job that started it, such as an email address, or an origin type such as user or system
+	Origin string
+
+	// Container path, e.g. group/project; matches jobs whose destination is that container or anything in it
+	Destination string
+
+	// Creation time bounds: a date, an RFC 3339 time, or a duration before now such as 24h or 7d
+	Since string
+	Until string
+}
+
+// JobRecord is a job as listed by the server.
+type JobRecord struct {
+	Id            string                  `json:"id"`
+	GearId        string                  `json:"gear_id"`
+	GearInfo      *JobGearInfo            `json:"gear_info,omitempty"`
+	State         api.JobState            `json:"state"`
+	Attempt       int                     `json:"attempt"`
+	Origin        *JobOrigin              `json:"origin,omitempty"`
+	Destination   *api.ContainerReference `json:"destination,omitempty"`
+	Parents       map[string]string       `json:"parents,omitempty"`
+	Tags          []string                `json:"tags"`
+	Created       *time.Time              `json:"created,omitempty"`
+	Modified      *time.Time              `json:"modified,omitempty"`
+	PreviousJobId string                  `json:"previous_job_id,omitempty"`
+
+	// Older servers send the id under this key
+	LegacyId string `json:"_id,omitempty"`
+}
+
+type JobGearInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type JobOrigin struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+// Gear is the job's gear as name:version, or its gear id when neither is known.
+func (j *JobRecord) Gear() string {
+	if j.GearInfo == nil || j.GearInfo.Name == "" {
+		return j.GearId
+	}
+	if j.GearInfo.Version == "" {
+		return j.GearInfo.Name
+	}
+	return j.GearInfo.Name + ":" + j.GearInfo.Version
+}
+
+// jobQuery is a JobFilter with its values parsed and its destination resolved.
+type jobQuery struct {
+	states        map[api.JobState]bool
+	gearName      string
+	gearVersion   string
+	tags          []string
+	origin        string
+	destinationId string
+	since         time.Time
+	until         time.Time
+}
+
+func (f *JobFilter) compile(client *api.Client) (*jobQuery, error) {
+	q := &jobQuery{states: map[api.JobState]bool{}, tags: f.Tags, origin: f.Origin}
+
+	for _, state := range f.States {
+		for _, x := range strings.Split(state, ",") {
+			switch s := api.JobState(strings.TrimSpace(x)); s {
+			case api.Pending, api.Running, api.Failed, api.Complete, api.Cancelled:
+				q.states[s] = true
+			default:
+				return nil, errors.New("Unknown job state " + x + "; use pending, running, failed, complete or cancelled")
+			}
+		}
+	}
+
+	q.gearName = f.Gear
+	if i := strings.Index(f.Gear, ":"); i >= 0 {
+		q.gearName, q.gearVersion = f.Gear[:i], f.Gear[i+1:]
+	}
+
+	var err error
+	now := time.Now()
+	if f.Since != "" {
+		if q.since, err = parseTimeArg(f.Since, now); err != nil {
+			return nil, err
+		}
+	}
+	if f.Until != "" {
+		if q.until, err = parseTimeArg(f.Until, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.Destination != "" {
+		result, _, err, aerr := legacy.ResolvePathString(client, strings.Trim(f.Destination, "/"))
+		if err = api.Coalesce(err, aerr); err != nil {
+			return nil, err
+		}
+		container, ok := result.Path[len(result.Path)-1].(legacy.Container)
+		if !ok || container.GetType() == "file" {
+			return nil, errors.New("Destination " + f.Destination + " must be a container, not a file")
+		}
+		q.destinationId = container.GetId()
+	}
+
+	return q, nil
+}
+
+// parseTimeArg reads a date, a time, or a duration before now. Durations may be given in days, e.g. 7d.
+func parseTimeArg(value string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Cannot read time " + value + "; use a date such as 2006-01-02, a time such as 2006-01-02T15:04:05, or a duration such as 24h or 7d")
+}
+
+func (q *jobQuery) matches(job *JobRecord) bool {
+	if len(q.states) > 0 && !q.states[job.State] {
+		return false
+	}
+
+	if q.gearName != "" {
+		if job.GearInfo == nil || job.GearInfo.Name != q.gearName {
+			return false
+		}
+		if q.gearVersion != "" && job.GearInfo.Version != q.gearVersion {
+			return false
+		}
+	}
+
+	for _, tag := range q.tags {
+		found := false
+		for _, x := range job.Tags {
+			if x == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.origin != "" {
+		if job.Origin == nil || (job.Origin.Id != q.origin && job.Origin.Type != q.origin) {
+			return false
+		}
+	}
+
+	if q.destinationId != "" {
+		found := job.Destination != nil && job.Destination.Id == q.destinationId
+		for _, id := range job.Parents {
+			found = found || id == q.destinationId
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if job.Created != nil {
+		if !q.since.IsZero() && job.Created.Before(q.since) {
+			return false
+		}
+		if !q.until.IsZero() && job.Created.After(q.until) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serverFilter narrows the listing on servers that support filtering. Every job is still checked locally,
+// so servers that ignore it return the same results, only slower.
+func (q *jobQuery) serverFilter() string {
+	var filters []string
+	if len(q.states) == 1 {
+		for state := range q.states {
+			filters = append(filters, "state="+string(state))
+		}
+	}
+	if q.gearName != "" {
+		filters = append(filters, "gear_info.name="+q.gearName)
+	}
+	for _, tag := range q.tags {
+		filters = append(filters, "tags="+tag)
+	}
+	if !q.since.IsZero() {
+		filters = append(filters, "created>="+q.since.UTC().Format("2006-01-02T15:04:05"))
+	}
+	if !q.until.IsZero() {
+		filters = append(filters, "created<="+q.until.UTC().Format("2006-01-02T15:04:05"))
+	}
+	return strings.Join(filters, ",")
+}
+
+// Jobs requested from the server at once
+const jobPageSize = 200
+
+type jobPage struct {
+	Results []*JobRecord `json:"results"`
+	Total   int          `json:"total"`
+}
+
+// findJobs lists the jobs matching the filter, newest first, skipping the first skip matches and returning at
+// most limit; a limit of 0 returns every match. more reports whether matches were left out past the limit.
+func findJobs(client *api.Client, filter *JobFilter, skip int, limit int) ([]*JobRecord, bool, error) {
+	q, err := filter.compile(client)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var result []*JobRecord
+	var gears map[string]*JobGearInfo
+	seen := map[string]bool{}
+	matched := 0
+
+	for offset := 0; ; offset += jobPageSize {
+		page, err := getJobPage(client, q.serverFilter(), offset)
+		if err != nil {
+			return nil, false, err
+		}
+
+		added := 0
+		for _, job := range page {
+			if job.Id == "" {
+				job.Id = job.LegacyId
+			}
+			job.LegacyId = ""
+
+			if seen[job.Id] {
+				continue
+			}
+			seen[job.Id] = true
+			added++
+
+			// Jobs from older servers only name their gear by id
+			if job.GearInfo == nil && job.GearId != "" {
+				if gears == nil {
+					if gears, err = gearInfoById(client); err != nil {
+						return nil, false, err
+					}
+				}
+				job.GearInfo = gears[job.GearId]
+			}
+
+			if !q.matches(job) {
+				continue
+			}
+			matched++
+			if matched <= skip {
+				continue
+			}
+			if limit > 0 && len(result) == limit {
+				return result, true, nil
+			}
+			result = append(result, job)
+		}
+
+		// A short page is the last; servers that do not page send everything at once
+		if len(page) < jobPageSize || added == 0 {
+			return result, false, nil
+		}
+	}
+}
+
+func getJobPage(client *api.Client, filter string, offset int) ([]*JobRecord, error) {
+	var aerr *api.Error
+	var raw json.RawMessage
+
+	query := &struct {
+		Filter string `url:"filter,omitempty"`
+		Sort   string `url:"sort"`
+		Limit  int    `url:"limit"`
+		Skip   int    `url:"skip,omitempty"`
+	}{filter, "created:desc", jobPageSize, offset}
+
+	_, err := client.New().Get("jobs").QueryStruct(query).Set("X-Accept-Feature", "pagination").Receive(&raw, &aerr)
+	if err = api.Coalesce(err, aerr); err != nil {
+		return nil, err
+	}
+
+	// Servers without pagination reply with a plain list
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		var list []*JobRecord
+		err = json.Unmarshal(raw, &list)
+		return list, err
+	}
+
+	var page jobPage
+	err = json.Unmarshal(raw, &page)
+	return page.Results, err
+}
+
+func gearInfoById(client *api.Client) (map[string]*JobGearInfo, error) {
+	gears, _, err := client.GetAllGears()
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]*JobGearInfo{}
+	for _, x := range gears {
+		result[x.Id] = &JobGearInfo{Name: x.Gear.Name, Version: x.Gear.Version}
+	}
+	return result, nil
+}
+
+// IsEmpty reports whether the filter would match every job.
+func (f *JobFilter) IsEmpty() bool {
+	return len(f.States) == 0 && f.Gear == "" && len(f.Tags) == 0 && f.Origin == "" && f.Destination == "" &&
+		f.Since == "" && f.Until == ""
+}
+
+func getJobRecord(client *api.Client, id string) (*JobRecord, error) {
+	var aerr *api.Error
+	var job *JobRecord
+
+	_, err := client.New().Get("jobs/"+id).Receive(&job, &aerr)
+	if err = api.Coalesce(err, aerr); err != nil {
+		return nil, err
+	}
+	if job.Id == "" {
+		job.Id = job.LegacyId
+	}
+	job.LegacyId = ""
+	return job, nil
+}
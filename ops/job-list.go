@@ -1,9 +1,16 @@
 package ops
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/fatih/color"
 
@@ -14,6 +21,107 @@ import (
 
 var greenBold = color.New(color.FgGreen, color.Bold).SprintFunc()
 
+var stateColors = map[api.JobState]func(a ...interface{}) string{
+	api.Pending:   color.New(color.FgYellow).SprintFunc(),
+	api.Running:   color.New(color.FgCyan).SprintFunc(),
+	api.Complete:  color.New(color.FgGreen).SprintFunc(),
+	api.Failed:    color.New(color.FgRed).SprintFunc(),
+	api.Cancelled: color.New(color.FgMagenta).SprintFunc(),
+}
+
+// Output formats for job listings
+const (
+	FormatTable = "table"
+	FormatJson  = "json"
+	FormatCsv   = "csv"
+)
+
+// ListJobs prints the jobs matching a filter, newest first, a page of limit jobs at a time.
+func ListJobs(client *api.Client, filter *JobFilter, format string, limit int, page int) {
+	if format != FormatTable && format != FormatJson && format != FormatCsv {
+		FatalWithMessage("Unknown format " + format + "; use " + FormatTable + ", " + FormatJson + " or " + FormatCsv)
+	}
+	if limit < 1 || page < 1 {
+		FatalWithMessage("--limit and --page must be at least 1")
+	}
+
+	jobs, more, err := findJobs(client, filter, (page-1)*limit, limit)
+	Check(err)
+
+	switch format {
+	case FormatJson:
+		if jobs == nil {
+			jobs = []*JobRecord{}
+		}
+		raw, err := json.MarshalIndent(jobs, "", "\t")
+		Check(err)
+		fmt.Println(string(raw))
+
+	case FormatCsv:
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"id", "gear", "state", "created", "modified", "destination_type", "destination_id", "origin", "tags"})
+		for _, job := range jobs {
+			destType, destId := "", ""
+			if job.Destination != nil {
+				destType, destId = job.Destination.Type, job.Destination.Id
+			}
+			w.Write([]string{job.Id, job.Gear(), string(job.State), formatJobTime(job.Created, time.RFC3339), formatJobTime(job.Modified, time.RFC3339), destType, destId, jobOrigin(job), strings.Join(job.Tags, ";")})
+		}
+		w.Flush()
+		Check(w.Error())
+
+	default:
+		if len(jobs) == 0 {
+			Println("No jobs found.")
+			return
+		}
+
+		printJobTable(color.Output, jobs)
+	}
+
+	if more {
+		Println("More jobs match; use --page " + strconv.Itoa(page+1) + " to see the next " + strconv.Itoa(limit) + ".")
+	}
+}
+
+// printJobTable writes jobs as a table with colored states.
+func printJobTable(out io.Writer, jobs []*JobRecord) {
+	w := tabwriter.NewWriter(out, 0, 2, 1, ' ', 0)
+	fmt.Fprintf(w, "ID\tGEAR\tSTATE\tCREATED\tDESTINATION\tORIGIN\tTAGS\n")
+	for _, job := range jobs {
+		state := string(job.State)
+		if colorize, ok := stateColors[job.State]; ok {
+			state = colorize(state)
+		}
+		dest := ""
+		if job.Destination != nil {
+			dest = job.Destination.Type + " " + job.Destination.Id
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", job.Id, greenBold(job.Gear()), state, formatJobTime(job.Created, "2006-01-02 15:04"), dest, jobOrigin(job), strings.Join(job.Tags, ", "))
+	}
+	w.Flush()
+}
+
+func formatJobTime(t *time.Time, layout string) string {
+	if t == nil {
+		return ""
+	}
+	if layout == time.RFC3339 {
+		return t.UTC().Format(layout)
+	}
+	return t.Local().Format(layout)
+}
+
+func jobOrigin(job *JobRecord) string {
+	if job.Origin == nil {
+		return ""
+	}
+	if job.Origin.Id == "" {
+		return job.Origin.Type
+	}
+	return job.Origin.Id
+}
+
 func ListGears(client *api.Client) {
 	gears, _, err := client.GetAllGears()
 	Check(err)
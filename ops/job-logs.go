@@ -0,0 +1,188 @@
+package ops
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"flywheel.io/sdk/api"
+
+	. "flywheel.io/fw/util"
+)
+
+// How often a followed log is checked for new output
+const logInterval = 2 * time.Second
+
+const logTimeLayout = "2006-01-02 15:04:05"
+
+// Printed in place of the time for statements the engine logged without one, keeping the columns aligned
+var noLogTime = strings.Repeat("-", len(logTimeLayout))
+
+// jobLogStatement is one chunk of an engine log. Fd is 1 for the gear's stdout, 2 for its stderr, and -1 for
+// messages from the engine itself.
+type jobLogStatement struct {
+	Fd        int        `json:"fd"`
+	Msg       string     `json:"msg"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+type jobLog struct {
+	Id   string             `json:"_id"`
+	Logs []*jobLogStatement `json:"logs"`
+}
+
+func getJobLogs(client *api.Client, id string) (*jobLog, error) {
+	var aerr *api.Error
+	var result *jobLog
+
+	_, err := client.New().Get("jobs/"+id+"/logs").Receive(&result, &aerr)
+	if err = api.Coalesce(err, aerr); err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = &jobLog{Id: id}
+	}
+	return result, nil
+}
+
+func isTerminal(state api.JobState) bool {
+	return state == api.Complete || state == api.Failed || state == api.Cancelled
+}
+
+// logPrinter writes the statements of a job log it has not written yet: the gear's stdout to stdout, and its
+// stderr and engine messages to stderr.
+type logPrinter struct {
+	timestamps bool
+	printed    int
+
+	// Whether the last write to each stream ended partway through a line
+	midLine map[io.Writer]bool
+}
+
+func newLogPrinter(timestamps bool) *logPrinter {
+	return &logPrinter{timestamps: timestamps, midLine: map[io.Writer]bool{}}
+}
+
+// print writes the statements not yet printed, reporting whether there were any.
+func (p *logPrinter) print(log *jobLog) bool {
+	if p.printed > len(log.Logs) {
+		// The log was restarted, as happens when a job is retried
+		p.printed = 0
+	}
+
+	for _, statement := range log.Logs[p.printed:] {
+		p.write(statement)
+	}
+	printed := len(log.Logs) > p.printed
+	p.printed = len(log.Logs)
+	return printed
+}
+
+func (p *logPrinter) write(statement *jobLogStatement) {
+	var w io.Writer = os.Stderr
+	if statement.Fd == 1 {
+		w = os.Stdout
+	}
+
+	msg := statement.Msg
+	if !p.timestamps {
+		fmt.Fprint(w, msg)
+		return
+	}
+
+	prefix := noLogTime + " "
+	if statement.Timestamp != nil {
+		prefix = statement.Timestamp.Local().Format(logTimeLayout) + " "
+	}
+
+	for msg != "" {
+		if !p.midLine[w] {
+			fmt.Fprint(w, prefix)
+		}
+		i := strings.Index(msg, "\n")
+		if i < 0 {
+			fmt.Fprint(w, msg)
+			p.midLine[w] = true
+			return
+		}
+		fmt.Fprint(w, msg[:i+1])
+		p.midLine[w] = false
+		msg = msg[i+1:]
+	}
+}
+
+// JobLogs prints a job's engine log. When following, it keeps printing new output until the job finishes,
+// then exits 0 if the job completed and 1 otherwise.
+func JobLogs(client *api.Client, id string, follow bool, timestamps bool) {
+	printer := newLogPrinter(timestamps)
+
+	if !follow {
+		log, err := getJobLogs(client, id)
+		Check(err)
+		printer.print(log)
+		return
+	}
+
+	state := followLogs(client, id, printer, logInterval, logInterval, time.Time{}, nil)
+	if state == api.Complete {
+		Fatal(0)
+	} else {
+		Fatal(1)
+	}
+}
+
+// followLogs prints new log output until the job reaches a terminal state, which it returns, or until the deadline
+// passes, when it returns timedOut. A zero deadline never passes. Checks start every interval and slow down while
+// nothing changes, up to maxInterval. Fetch errors are reported and retried. onState, if given, is called whenever
+// the state changes.
+func followLogs(client *api.Client, id string, printer *logPrinter, interval time.Duration, maxInterval time.Duration, deadline time.Time, onState func(api.JobState)) api.JobState {
+	state := api.JobState("")
+	wait := interval
+
+	for first := true; ; first = false {
+		if !first {
+			if !deadline.IsZero() && time.Until(deadline) < wait {
+				wait = time.Until(deadline)
+			}
+			time.Sleep(wait)
+		}
+
+		changed := false
+		job, _, err := client.GetJob(id)
+		var log *jobLog
+		if err == nil {
+			// The log is fetched after the state, so a finished job's log is complete
+			log, err = getJobLogs(client, id)
+		}
+
+		if err != nil {
+			Println(err)
+			Println("Will continue to retry. Press Control-C to exit.")
+		} else {
+			changed = printer.print(log)
+
+			if job.State != state {
+				state = job.State
+				changed = true
+				if onState != nil {
+					onState(state)
+				}
+			}
+			if isTerminal(state) {
+				return state
+			}
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return timedOut
+		}
+
+		if changed {
+			wait = interval
+		} else if wait = time.Duration(float64(wait) * waitBackoff); wait > maxInterval {
+			wait = maxInterval
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package ops
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/kennygrant/sanitize"
+
+	"flywheel.io/sdk/api"
+
+	"flywheel.io/fw/legacy"
+	. "flywheel.io/fw/util"
+)
+
+// outputFile is a file on a container, with the job that wrote it.
+type outputFile struct {
+	Name   string `json:"name"`
+	Size   uint64 `json:"size"`
+	Origin *struct {
+		Type string `json:"type"`
+		Id   string `json:"id"`
+	} `json:"origin"`
+}
+
+// JobOutputs downloads the files a job wrote to its destination, or to its analysis, into dir.
+// With wait, it first waits for the job to finish.
+func JobOutputs(client *api.Client, id string, dir string, wait bool, force bool) {
+	job, err := getJobRecord(client, id)
+	Check(err)
+
+	if !isTerminal(job.State) {
+		if !wait {
+			FatalWithMessage("Job is " + string(job.State) + "; use --wait to wait for it to finish.")
+		}
+		states := waitForJobs(client, []string{job.Id}, &JobWaitOptions{Interval: 10 * time.Second, MaxInterval: 2 * time.Minute})
+		job.State = states[job.Id]
+	}
+	if job.State != api.Complete {
+		Println("Job is " + string(job.State) + "; downloading any outputs it saved.")
+	}
+
+	parent, files, err := jobOutputFiles(client, job)
+	Check(err)
+
+	if len(files) == 0 {
+		Println("Job " + job.Id + " did not produce any files.")
+		return
+	}
+
+	Check(os.MkdirAll(dir, 0755))
+
+	var total uint64
+	downloaded, failed := 0, 0
+	for _, file := range files {
+		dest := filepath.Join(dir, sanitize.Name(file.Name))
+		if _, err := os.Stat(dest); err == nil && !force {
+			Println("Skipping " + dest + ", which already exists; use --force to overwrite.")
+			continue
+		}
+
+		_, err := legacy.DownloadToFile(client, file.Name, parent, dest)
+		if err != nil {
+			Println("Failed to download", file.Name+":", err)
+			failed++
+			continue
+		}
+		Println("Downloaded", dest)
+		downloaded++
+		total += file.Size
+	}
+
+	Println("Downloaded", downloaded, "files,", humanize.Bytes(total)+".")
+	if failed > 0 {
+		Fatal(1)
+	}
+}
+
+// jobOutputFiles finds the container a job saved its outputs to, and the files on it the job wrote.
+func jobOutputFiles(client *api.Client, job *JobRecord) (interface{}, []*outputFile, error) {
+	if job.Destination == nil || job.Destination.Id == "" {
+		return nil, nil, errors.New("Job " + job.Id + " has no destination")
+	}
+
+	var parent interface{}
+	var url string
+	switch id := job.Destination.Id; job.Destination.Type {
+	case "project":
+		parent, url = &legacy.Project{Id: id}, "projects/"+id
+	case "subject":
+		parent, url = &legacy.Subject{Id: id}, "subjects/"+id
+	case "session":
+		parent, url = &legacy.Session{Id: id}, "sessions/"+id
+	case "acquisition":
+		parent, url = &legacy.Acquisition{Id: id}, "acquisitions/"+id
+	case "analysis":
+		parent, url = &legacy.Analysis{Id: id}, "analyses/"+id
+	default:
+		return nil, nil, errors.New("Cannot download outputs from a " + job.Destination.Type)
+	}
+
+	var aerr *api.Error
+	var container *struct {
+		Files []*outputFile `json:"files"`
+	}
+	_, err := client.New().Get(url).Receive(&container, &aerr)
+	if err = api.Coalesce(err, aerr); err != nil {
+		return nil, nil, err
+	}
+	if container == nil {
+		return parent, nil, nil
+	}
+
+	// An analysis holds only its outputs; other containers hold files from anywhere, so keep those the job wrote
+	var files []*outputFile
+	for _, file := range container.Files {
+		if job.Destination.Type == "analysis" || (file.Origin != nil && file.Origin.Type == "job" && file.Origin.Id == job.Id) {
+			files = append(files, file)
+		}
+	}
+	return parent, files, nil
+}
@@ -0,0 +1,56 @@
+package ops
+
+import (
+	"flywheel.io/sdk/api"
+
+	. "flywheel.io/fw/util"
+)
+
+// RetryJobs retries the jobs given by id, or every job matching the filter. When filtering without a state,
+// only failed jobs are selected. Completed jobs are only retried when includeComplete is set.
+func RetryJobs(client *api.Client, ids []string, filter *JobFilter, includeComplete bool, yes bool) {
+	if len(ids) == 0 {
+		if filter.IsEmpty() {
+			FatalWithMessage("Give job ids, or filters such as --failed-since or --gear to select the jobs to retry.")
+		}
+		if len(filter.States) == 0 {
+			filter.States = []string{string(api.Failed)}
+		}
+	}
+
+	jobs, results, err := selectJobs(client, ids, filter)
+	Check(err)
+
+	if len(jobs) == 0 && len(results) == 0 {
+		Println("No jobs found.")
+		return
+	}
+	if len(jobs) > 0 && !confirmJobs(jobs, "retry", yes) {
+		return
+	}
+
+	applyToJobs(jobs, results, "retried", func(job *JobRecord) *JobActionResult {
+		if job.State != api.Failed && !(includeComplete && job.State == api.Complete) {
+			return &JobActionResult{Status: ActionSkipped, Error: "job is " + string(job.State) + ", not failed"}
+		}
+
+		var aerr *api.Error
+		var result *struct {
+			Id string `json:"_id"`
+		}
+		query := &struct {
+			IgnoreState bool `url:"ignoreState,omitempty"`
+		}{job.State == api.Complete}
+
+		_, err := client.New().Post("jobs/"+job.Id+"/retry").QueryStruct(query).Receive(&result, &aerr)
+		if err = api.Coalesce(err, aerr); err != nil {
+			return &JobActionResult{Status: ActionFailed, Error: err.Error()}
+		}
+
+		x := &JobActionResult{Status: ActionDone}
+		if result != nil {
+			x.NewId = result.Id
+		}
+		return x
+	})
+}
@@ -1,7 +1,11 @@
 package ops
 
 import (
+	"encoding/json"
+	"errors"
 	. "fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"flywheel.io/sdk/api"
@@ -9,36 +13,252 @@ import (
 	"flywheel.io/fw/util"
 )
 
-func JobWait(client *api.Client, id string) {
-	first := true
-	interval := 10 * time.Second
-	state := api.JobState("")
+// Exit codes of fw job wait. When jobs end differently, timing out wins over failure, and failure over cancellation.
+const (
+	WaitComplete  = 0
+	WaitFailed    = 1
+	WaitCancelled = 2
+	WaitTimedOut  = 3
+)
 
-	for state != api.Cancelled && state != api.Failed && state != api.Complete {
+// Polling slows by this factor each time nothing changes, up to MaxInterval
+const waitBackoff = 1.5
 
-		if first {
-			first = false
-		} else {
-			time.Sleep(interval)
+type JobWaitOptions struct {
+	Ids   []string
+	Batch string
+	Tag   string
+
+	// Zero waits forever
+	Timeout time.Duration
+
+	Interval    time.Duration
+	MaxInterval time.Duration
+
+	// Stop as soon as any job fails or is cancelled
+	FailFast bool
+
+	// Print the log of the job while waiting; only for a single job
+	Logs bool
+}
+
+func JobWait(client *api.Client, opts *JobWaitOptions) {
+	ids, err := waitTargets(client, opts)
+	util.Check(err)
+
+	if len(ids) == 0 {
+		Println("No jobs to wait for.")
+		util.Fatal(WaitComplete)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+	if opts.MaxInterval < opts.Interval {
+		opts.MaxInterval = opts.Interval
+	}
+	if opts.Logs && len(ids) > 1 {
+		util.FatalWithMessage("--logs can only be used when waiting for a single job.")
+	}
+
+	if opts.Logs {
+		var deadline time.Time
+		if opts.Timeout > 0 {
+			deadline = time.Now().Add(opts.Timeout)
 		}
 
-		job, _, err := client.GetJob(id)
+		state := followLogs(client, ids[0], newLogPrinter(false), opts.Interval, opts.MaxInterval, deadline, func(state api.JobState) {
+			Println("Job is", state)
+		})
+		if state == timedOut {
+			Println("Timed out after", opts.Timeout)
+		}
+		util.Fatal(waitExitCode(map[string]api.JobState{ids[0]: state}))
+	}
+
+	states := waitForJobs(client, ids, opts)
+	util.Fatal(waitExitCode(states))
+}
+
+// waitTargets collects the ids to wait for from the ids, batch and tag given.
+func waitTargets(client *api.Client, opts *JobWaitOptions) ([]string, error) {
+	ids := append([]string{}, opts.Ids...)
+
+	if opts.Batch != "" {
+		batchIds, err := getBatchJobIds(client, opts.Batch)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, batchIds...)
+	}
+
+	if opts.Tag != "" {
+		jobs, _, err := findJobs(client, &JobFilter{Tags: []string{opts.Tag}}, 0, 0)
 		if err != nil {
-			Println(err)
-			Println("Will continue to retry. Press Control-C to exit.")
+			return nil, err
+		}
+		for _, job := range jobs {
+			ids = append(ids, job.Id)
+		}
+	}
+
+	var result []string
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result, nil
+}
+
+// getBatchJobIds lists the jobs of a batch, which the server sends as ids or as job documents.
+func getBatchJobIds(client *api.Client, id string) ([]string, error) {
+	var aerr *api.Error
+	var batch *struct {
+		Jobs []json.RawMessage `json:"jobs"`
+	}
+
+	_, err := client.New().Get("batch/"+id).Receive(&batch, &aerr)
+	if err = api.Coalesce(err, aerr); err != nil {
+		return nil, err
+	}
+	if batch == nil || len(batch.Jobs) == 0 {
+		return nil, errors.New("Batch " + id + " has no jobs; it may not have been started")
+	}
+
+	var ids []string
+	for _, raw := range batch.Jobs {
+		var jobId string
+		if json.Unmarshal(raw, &jobId) != nil {
+			var job JobRecord
+			if err := json.Unmarshal(raw, &job); err != nil {
+				return nil, err
+			}
+			jobId = job.Id
+			if jobId == "" {
+				jobId = job.LegacyId
+			}
 		}
-		if job != nil {
-			if job.State != state {
-				state = job.State
-				Println("Job is", state)
+		ids = append(ids, jobId)
+	}
+	return ids, nil
+}
+
+// waitForJobs polls the jobs until all have finished, the timeout passes, or with FailFast, one fails or is
+// cancelled. Returns the last state seen of each job.
+func waitForJobs(client *api.Client, ids []string, opts *JobWaitOptions) map[string]api.JobState {
+	start := time.Now()
+	interval := opts.Interval
+	states := map[string]api.JobState{}
+	single := len(ids) == 1
+
+	for first := true; ; first = false {
+		if !first {
+			if opts.Timeout > 0 && time.Since(start)+interval > opts.Timeout {
+				interval = opts.Timeout - time.Since(start)
 			}
-			state = job.State
+			time.Sleep(interval)
 		}
+
+		changed := false
+		for _, id := range ids {
+			if isTerminal(states[id]) {
+				continue
+			}
+
+			job, _, err := client.GetJob(id)
+			if err != nil {
+				Println(err)
+				Println("Will continue to retry. Press Control-C to exit.")
+				continue
+			}
+			if job.State != states[id] {
+				states[id] = job.State
+				changed = true
+				if single {
+					Println("Job is", job.State)
+				} else {
+					Println("Job", id, "is", job.State)
+				}
+			}
+		}
+
+		finished := 0
+		for _, id := range ids {
+			if isTerminal(states[id]) {
+				finished++
+			}
+		}
+
+		if changed && !single {
+			Println(waitSummary(ids, states, time.Since(start)))
+		}
+
+		if finished == len(ids) {
+			return states
+		}
+		if opts.FailFast && waitExitCode(states) != WaitComplete {
+			Println("Stopping, as a job did not complete.")
+			return states
+		}
+		if opts.Timeout > 0 && time.Since(start) >= opts.Timeout {
+			Println("Timed out after", opts.Timeout, "with", len(ids)-finished, "jobs unfinished.")
+			markTimedOut(ids, states)
+			return states
+		}
+
+		if changed {
+			interval = opts.Interval
+		} else if interval = time.Duration(float64(interval) * waitBackoff); interval > opts.MaxInterval {
+			interval = opts.MaxInterval
+		}
+	}
+}
+
+// Recorded for jobs still unfinished when the timeout passes
+const timedOut = api.JobState("timed out")
+
+func markTimedOut(ids []string, states map[string]api.JobState) {
+	for _, id := range ids {
+		if !isTerminal(states[id]) {
+			states[id] = timedOut
+		}
+	}
+}
+
+// waitSummary counts the jobs in each state, e.g. "2 complete, 1 running, 3 pending (1m30s)".
+func waitSummary(ids []string, states map[string]api.JobState, elapsed time.Duration) string {
+	counts := map[string]int{}
+	for _, id := range ids {
+		state := string(states[id])
+		if state == "" {
+			state = "unknown"
+		}
+		counts[state]++
 	}
 
-	if state == api.Complete {
-		util.Fatal(0)
-	} else {
-		util.Fatal(1)
+	var parts []string
+	for state, n := range counts {
+		parts = append(parts, Sprintf("%d %s", n, state))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ") + " (" + elapsed.Truncate(time.Second).String() + ")"
+}
+
+// waitExitCode picks the exit code for the jobs' states. Jobs still running are ignored, as happens when
+// stopping early with FailFast.
+func waitExitCode(states map[string]api.JobState) int {
+	code := WaitComplete
+	for _, state := range states {
+		switch {
+		case state == timedOut:
+			return WaitTimedOut
+		case state == api.Failed:
+			code = WaitFailed
+		case state == api.Cancelled && code == WaitComplete:
+			code = WaitCancelled
+		}
 	}
+	return code
 }
@@ -0,0 +1,341 @@
+package ops
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"flywheel.io/sdk/api"
+
+	. "flywheel.io/fw/util"
+)
+
+// Ways of uploading the folders found under an acquisition.
+const (
+	// Stream the files to the server, which assembles the archive
+	PackPackfile = "packfile"
+
+	// Zip the folder locally and upload the archive as a single file
+	PackZip = "zip"
+)
+
+var packMode = PackPackfile
+var defaultPackfileType = ""
+var packfileTypes = map[string]string{}
+
+func setPackOptions(mode string, types []string) error {
+	switch mode {
+	case "", PackPackfile:
+		packMode = PackPackfile
+	case PackZip:
+		packMode = PackZip
+	default:
+		return errors.New("Unknown pack mode " + mode + "; use " + PackPackfile + " or " + PackZip)
+	}
+
+	for _, x := range types {
+		parts := strings.SplitN(x, "=", 2)
+		if len(parts) == 2 {
+			packfileTypes[parts[0]] = parts[1]
+		} else {
+			defaultPackfileType = x
+		}
+	}
+
+	return nil
+}
+
+// packfileType returns the file type for a packfile folder, which defaults to the folder name.
+func packfileType(folder string) string {
+	if packType, ok := packfileTypes[folder]; ok {
+		return packType
+	} else if defaultPackfileType != "" {
+		return defaultPackfileType
+	} else {
+		return folder
+	}
+}
+
+// packfileSources lists every file below folder, named by its slash-separated path relative to folder.
+func packfileSources(folder string) ([]*api.UploadSource, error) {
+	var sources []*api.UploadSource
+
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Ignore files and folders that begin with a dot, as scan does
+		if path != folder && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(folder, path)
+		if err != nil {
+			return err
+		}
+
+		src := api.CreateUploadSourceFromFilenames(path)[0]
+		src.Name = filepath.ToSlash(rel)
+		sources = append(sources, src)
+		return nil
+	})
+
+	return sources, err
+}
+
+// zipFolder writes every file below folder to a zip archive, keeping relative paths.
+func zipFolder(w io.Writer, folder string) error {
+	zipWriter := zip.NewWriter(w)
+
+	sources, err := packfileSources(folder)
+	if err != nil {
+		return err
+	}
+
+	for _, src := range sources {
+		err = addZipMember(zipWriter, src)
+		if err != nil {
+			return err
+		}
+	}
+
+	return zipWriter.Close()
+}
+
+func addZipMember(zipWriter *zip.Writer, src *api.UploadSource) error {
+	file, err := os.Open(src.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = src.Name
+	header.Method = zip.Deflate
+
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+// uploadZip zips a packfile folder locally and uploads it to the acquisition as a single file.
+func (r *scanAcquisition) uploadZip(x *api.UploadSource, name, packType string) {
+	zipName := name + ".zip"
+	Println("Upload zip", zipName)
+
+	start := time.Now()
+	var written int64
+
+	err := retry(func() error {
+		mdRaw, err := json.Marshal(map[string]interface{}{
+			"name": zipName,
+			"type": packType,
+		})
+		if err != nil {
+			return err
+		}
+
+		reader, writer := io.Pipe()
+		go func() {
+			// Closing with the zip error aborts the upload instead of sending a truncated file
+			writer.CloseWithError(zipFolder(writer, x.Path))
+		}()
+
+		src := &api.UploadSource{Name: zipName, Reader: reader}
+		progress, result := c.UploadSimple("acquisitions/"+r.Id+"/files", mdRaw, src)
+
+		for update := range progress {
+			written = int64(update)
+			Println("  Uploaded", humanize.Bytes(uint64(update)))
+		}
+
+		return <-result
+	})
+
+	recordFile(zipName, x.Path, "acquisitions/"+r.Id, written, start, err)
+}
+
+// uploadPackfile streams the files of a packfile folder to the server, which assembles them into the acquisition.
+func (r *scanAcquisition) uploadPackfile(x *api.UploadSource, name, packType, projectId string, metadata map[string]interface{}) {
+	Println("Upload packfile", name)
+
+	start := time.Now()
+	var written int64
+
+	err := retry(func() error {
+
+		metadata["packfile"] = map[string]interface{}{
+			"type": packType,
+		}
+
+		mdRaw, err := json.Marshal(&metadata)
+		if err != nil {
+			return err
+		}
+		mdString := string(mdRaw)
+
+		var aerr *api.Error
+
+		type tokenResponse struct {
+			Token string `json:"token"`
+		}
+
+		var response *tokenResponse
+
+		_, err = c.New().Post("projects/"+projectId+"/packfile-start").Receive(&response, &aerr)
+
+		if err != nil {
+			return err
+		} else if aerr != nil {
+			return errors.New(aerr.Message)
+		} else if response == nil || response.Token == "" {
+			return errors.New("Packfile token was empty or missing")
+		}
+
+		token := response.Token
+
+		Println("Scanning", x.Path)
+		paths, err := packfileSources(x.Path)
+		if err != nil {
+			return err
+		}
+
+		progress, result := c.UploadSimple("projects/"+projectId+"/packfile?token="+token, nil, paths...)
+
+		for update := range progress {
+			written = int64(update)
+			Println("  Uploaded", humanize.Bytes(uint64(update)))
+		}
+
+		err = <-result
+		if err != nil {
+			return err
+		}
+
+		/*
+			metadata:{"project":{"_id":"58a47373d2b6ed0013a4a9fb"},"session":{"label":"01/01/70 00:00 AM","subject":{"code":"XXX"}},"acquisition":{"label":"Localizer","timestamp":"1970-01-01T06:00:00.000Z"},"packfile":{"type":"dicom"}}
+		*/
+		packfileQuery := &PackfileQuery{
+			Token:    token,
+			Metadata: mdString,
+		}
+
+		req, err := c.New().Get("projects/" + projectId + "/packfile-end").QueryStruct(packfileQuery).Request()
+
+		if err != nil {
+			return err
+		}
+
+		// Start SSE
+		resp, err := c.Doer.Do(req)
+		if err != nil {
+			return err
+		}
+
+		defer resp.Body.Close()
+
+		// Wait for SSE
+		if resp.StatusCode == 200 {
+			result, err := readPackfileEvents(resp.Body)
+			if err != nil {
+				return err
+			}
+
+			// The server places the packfile by label; adopt the acquisition it chose
+			if result.AcquisitionId != "" {
+				r.Id = result.AcquisitionId
+			}
+			return nil
+		} else {
+			// Needs robust handling for body & raw nils
+			raw, _ := ioutil.ReadAll(resp.Body)
+			return errors.New(string(raw))
+		}
+	})
+
+	recordFile(name, x.Path, "acquisitions/"+r.Id, written, start, err)
+}
+
+type packfileProgress struct {
+	Done    int `json:"done"`
+	Total   int `json:"total"`
+	Percent int `json:"percent"`
+}
+
+type packfileResult struct {
+	AcquisitionId string `json:"acquisition_id"`
+	SessionId     string `json:"session_id"`
+}
+
+// readPackfileEvents follows the packfile-end event stream, printing packing progress.
+// An error event, or a stream that ends without a result, fails the packfile.
+func readPackfileEvents(body io.Reader) (*packfileResult, error) {
+	var result *packfileResult
+	lastPercent := -1
+
+	err := readEvents(body, func(event *sseEvent) error {
+		switch event.Event {
+		case "progress":
+			var progress packfileProgress
+			err := json.Unmarshal([]byte(event.Data), &progress)
+			if err != nil {
+				return err
+			}
+
+			if progress.Percent != lastPercent {
+				lastPercent = progress.Percent
+				Println("  Packed", progress.Done, "of", progress.Total, "files ("+strconv.Itoa(progress.Percent)+"%)")
+			}
+
+		case "result":
+			result = &packfileResult{}
+			return json.Unmarshal([]byte(event.Data), result)
+
+		case "error":
+			var aerr api.Error
+			if json.Unmarshal([]byte(event.Data), &aerr) == nil && aerr.Message != "" {
+				return errors.New("Server failed to pack files: " + aerr.Message)
+			}
+			return errors.New("Server failed to pack files: " + event.Data)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	} else if result == nil {
+		return nil, errors.New("Packfile event stream ended without a result")
+	}
+
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package ops
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"flywheel.io/sdk/api"
+
+	. "flywheel.io/fw/util"
+)
+
+// packfileServer stands in for the packfile endpoints of a project, answering packfile-end with status and body.
+func packfileServer(t *testing.T, status int, body string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/packfile-start"):
+			fmt.Fprint(w, `{"token":"t"}`)
+
+		case strings.HasSuffix(r.URL.Path, "/packfile"):
+			io.Copy(ioutil.Discard, r.Body)
+			fmt.Fprint(w, `[]`)
+
+		case strings.HasSuffix(r.URL.Path, "/packfile-end"):
+			if r.URL.Query().Get("token") != "t" {
+				t.Errorf("packfile-end got token %q", r.URL.Query().Get("token"))
+			}
+			if status == http.StatusOK {
+				w.Header().Set("Content-Type", "text/event-stream")
+			}
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestUploadPackfile(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		wantId string
+		err    string
+	}{
+		{
+			name:   "adopts the acquisition of the result",
+			status: http.StatusOK,
+			body:   "event: result\ndata: {\"acquisition_id\":\"placed\",\"session_id\":\"s\"}\n\n",
+			wantId: "placed",
+		},
+		{
+			name:   "result without an acquisition",
+			status: http.StatusOK,
+			body:   "event: result\ndata: {\"session_id\":\"s\"}\n\n",
+			wantId: "original",
+		},
+		{
+			name:   "result cut off",
+			status: http.StatusOK,
+			body:   "event: result\ndata: {\"acquisition_id\":\"placed\"}",
+			wantId: "original",
+			err:    "Event stream ended in the middle of an event",
+		},
+		{
+			name:   "error status",
+			status: http.StatusInternalServerError,
+			body:   "packing failed",
+			wantId: "original",
+			err:    "packing failed",
+		},
+	}
+
+	folder := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(folder, "1.dcm"), []byte("DICM"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unattended = true
+	retryBackoff = 0
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := packfileServer(t, tc.status, tc.body)
+			defer server.Close()
+
+			c = api.NewApiKeyClient(strings.TrimPrefix(server.URL, "https://")+":key", api.InsecureNoSSLVerification)
+			importReport = NewImportReport()
+
+			r := &scanAcquisition{Acquisition: &api.Acquisition{Id: "original"}}
+			r.uploadPackfile(&api.UploadSource{Path: folder}, "dicom", "dicom", "p", map[string]interface{}{})
+
+			if r.Id != tc.wantId {
+				t.Errorf("got acquisition %q, want %q", r.Id, tc.wantId)
+			}
+
+			file := importReport.Files[0]
+			if tc.err == "" && file.Status != FileUploaded {
+				t.Errorf("got status %s (%s), want %s", file.Status, file.Error, FileUploaded)
+			}
+			if tc.err != "" && (file.Status != FileFailed || file.Error != tc.err) {
+				t.Errorf("got status %s (%s), want %s (%s)", file.Status, file.Error, FileFailed, tc.err)
+			}
+		})
+	}
+}
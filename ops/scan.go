@@ -2,16 +2,16 @@ package ops
 
 import (
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	humanize "github.com/dustin/go-humanize"
+	isatty "github.com/mattn/go-isatty"
 	prompt "github.com/segmentio/go-prompt"
 
 	"flywheel.io/sdk/api"
@@ -36,6 +36,58 @@ func resolveLast(path []string) legacy.Container {
 	return result.Path[len(result.Path)-1].(legacy.Container)
 }
 
+// extendPath returns a copy of path with name appended, so sibling paths never share storage.
+func extendPath(path []string, name string) []string {
+	result := make([]string, len(path), len(path)+1)
+	copy(result, path)
+	return append(result, name)
+}
+
+// resolveChildren returns the children of a remote path, fetching each path at most once.
+func resolveChildren(path []string) []interface{} {
+	key := strings.Join(path, "/")
+
+	if children, ok := resolveCache[key]; ok {
+		return children
+	}
+
+	var children []interface{}
+	result, _, _, _ := legacy.ResolvePath(c, path)
+	if result != nil {
+		children = result.Children
+	}
+
+	resolveCache[key] = children
+	return children
+}
+
+func addSubject(subject *api.Subject, projectId string) (string, error) {
+	var aerr *api.Error
+
+	type subjectRequest struct {
+		Project string `json:"project"`
+		Code    string `json:"code"`
+	}
+
+	type idResponse struct {
+		Id string `json:"_id"`
+	}
+
+	var response *idResponse
+
+	_, err := c.New().Post("subjects").BodyJSON(&subjectRequest{Project: projectId, Code: subject.Code}).Receive(&response, &aerr)
+
+	if err != nil {
+		return "", err
+	} else if aerr != nil {
+		return "", errors.New(aerr.Message)
+	} else if response == nil || response.Id == "" {
+		return "", errors.New("Subject id was empty or missing")
+	}
+
+	return response.Id, nil
+}
+
 func scan(folder string, fn func(name string, mode os.FileMode)) {
 	files, err := ioutil.ReadDir(folder)
 	Check(err)
@@ -80,52 +132,236 @@ func rE(exists bool) string {
 	}
 }
 
-func retry(fn func() error) {
-	for {
+// With --yes, or without a terminal to ask on, failed requests are retried this many times instead of prompting
+const unattendedRetries = 3
+
+// Delay before the first unattended retry, doubled on every attempt after it
+var retryBackoff = 2 * time.Second
+
+var unattended bool
+
+// retry runs fn until it succeeds or the user gives up, returning the last error in the latter case.
+// Unattended, it retries with backoff and gives up after unattendedRetries.
+func retry(fn func() error) error {
+	backoff := retryBackoff
+
+	for attempt := 1; ; attempt++ {
 		err := fn()
+		if err == nil {
+			return nil
+		}
+		Println("An error occurred:", err.Error())
 
-		if err != nil {
-			Println("An error occurred:", err.Error())
-			proceed := prompt.Confirm("Retry? (yes/no)")
-			Println()
-			if !proceed {
-				Println("Canceled.")
-				Fatal(1)
+		if unattended {
+			if attempt > unattendedRetries {
+				Println("Skipped after", attempt, "attempts.")
+				return err
 			}
-		} else {
-			break
+			Println("Retrying in", backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+			continue
+		}
+
+		proceed := prompt.Confirm("Retry? (yes/no)")
+		Println()
+		if !proceed {
+			Println("Skipped.")
+			return err
 		}
 	}
 }
 
-func (r *scanRoot) discover(folder string) {
+func recordContainer(kind, label, id string, exists bool, err error) {
+	x := &ReportContainer{
+		Type:   kind,
+		Label:  label,
+		Id:     id,
+		Status: ContainerCreated,
+	}
+
+	if err != nil {
+		x.Status = ContainerFailed
+		x.Error = err.Error()
+	} else if exists {
+		x.Status = ContainerUsed
+	}
+
+	importReport.AddContainer(x)
+}
+
+func recordSkipped(kind, label string) {
+	importReport.AddContainer(&ReportContainer{
+		Type:   kind,
+		Label:  label,
+		Status: ContainerSkipped,
+	})
+}
+
+func skipFile(name, path, reason string) {
+	importReport.AddFile(&ReportFile{
+		Name:   name,
+		Path:   path,
+		Status: FileSkipped,
+		Error:  reason,
+	})
+}
+
+func recordFile(name, path, container string, written int64, start time.Time, err error) {
+	x := &ReportFile{
+		Name:      name,
+		Path:      path,
+		Container: container,
+		Status:    FileUploaded,
+		Bytes:     written,
+		Duration:  time.Since(start).Seconds(),
+	}
+
+	if err != nil {
+		x.Status = FileFailed
+		x.Error = err.Error()
+	}
+
+	importReport.AddFile(x)
+}
+
+// uploadFile sends an attachment to a container, recording the outcome.
+func uploadFile(container string, x *api.UploadSource) {
+	Println("Upload file", x.Name)
+
+	start := time.Now()
+	var written int64
+
+	err := retry(func() error {
+		progress, result := c.UploadSimple(container+"/files", nil, x)
+
+		for update := range progress {
+			written = int64(update)
+			Println("  Uploaded", humanize.Bytes(uint64(update)))
+		}
+
+		return <-result
+	})
+
+	recordFile(x.Name, x.Path, container, written, start, err)
+}
+
+func (r *scanRoot) discover(folder string, t *scanTemplate) {
+	r.walk(folder, t, 0, t.values())
+}
+
+// walk matches each folder against the template segment for its depth, creating containers as their labels become known.
+func (r *scanRoot) walk(folder string, t *scanTemplate, depth int, values map[string]string) {
 	scan(folder, func(name string, mode os.FileMode) {
-		if mode.IsDir() {
-			path := []string{name}
+		path := filepath.Join(folder, name)
 
-			group := &scanGroup{
-				Group: &api.Group{
-					Id: name,
-				},
-			}
+		if !mode.IsDir() {
+			r.attach(name, path, values)
+			return
+		}
 
-			if resolveLast(path) != nil {
-				group.Exists = true
-			}
+		if depth >= len(t.segments) {
+			fmt.Fprintln(&reportBottom, "Folder", path, "ignored as it is deeper than the template")
+			skipFile(name, path, "deeper than the template")
+			return
+		}
 
-			group.discover(filepath.Join(folder, name), path)
+		next, ok := t.match(depth, name, values)
+		if !ok {
+			fmt.Fprintln(&reportBottom, "Folder", path, "ignored as it does not match the template")
+			skipFile(name, path, "does not match the template")
+			return
+		}
 
-			r.Children = append(r.Children, group)
-		} else {
-			fmt.Fprintln(&reportBottom, "File", name, "ignored as attachments to root are not allowed")
+		// Everything inside an acquisition folder is uploaded as attachments and packfiles
+		if acquisition, ok := r.container(next).(*scanAcquisition); ok {
+			acquisition.discover(path)
+			return
 		}
+
+		r.walk(path, t, depth+1, next)
 	})
 }
 
+// container finds or creates each level named in values, returning the deepest one.
+func (r *scanRoot) container(values map[string]string) interface{} {
+	label, ok := values["group"]
+	if !ok {
+		return nil
+	}
+	group := r.group(label)
+
+	label, ok = values["project"]
+	if !ok {
+		return group
+	}
+	project := group.project(label)
+
+	label, ok = values["subject"]
+	if !ok {
+		return project
+	}
+	subject := project.subject(label)
+
+	label, ok = values["session"]
+	if !ok {
+		return subject
+	}
+	session := subject.session(label)
+
+	label, ok = values["acquisition"]
+	if !ok {
+		return session
+	}
+	return session.acquisition(label)
+}
+
+func (r *scanRoot) attach(name, path string, values map[string]string) {
+	switch x := r.container(values).(type) {
+	case *scanProject:
+		x.Attachments = append(x.Attachments, api.CreateUploadSourceFromFilenames(path)[0])
+	case *scanSubject:
+		x.Attachments = append(x.Attachments, api.CreateUploadSourceFromFilenames(path)[0])
+	case *scanSession:
+		x.Attachments = append(x.Attachments, api.CreateUploadSourceFromFilenames(path)[0])
+	case *scanGroup:
+		fmt.Fprintln(&reportBottom, "File", name, "ignored as attachments to groups are not allowed")
+		skipFile(name, path, "attachments to groups are not allowed")
+	default:
+		fmt.Fprintln(&reportBottom, "File", name, "ignored as attachments to root are not allowed")
+		skipFile(name, path, "attachments to root are not allowed")
+	}
+}
+
+func (r *scanRoot) group(id string) *scanGroup {
+	for _, x := range r.Children {
+		if x.Id == id {
+			return x
+		}
+	}
+
+	groups++
+	group := &scanGroup{
+		Group: &api.Group{
+			Id: id,
+		},
+		path: []string{id},
+	}
+
+	if resolveLast(group.path) != nil {
+		group.Exists = true
+	}
+
+	r.Children = append(r.Children, group)
+	return group
+}
+
 type scanGroup struct {
 	*api.Group
 	Exists   bool
 	Children []*scanProject
+
+	path []string
 }
 
 func (r *scanGroup) report(i string) {
@@ -136,46 +372,61 @@ func (r *scanGroup) report(i string) {
 	}
 }
 func (r *scanGroup) inflate() {
+	var err error
+
 	if !r.Exists {
 		Println("Creating group", r.Id)
 
-		retry(func() error {
+		err = retry(func() error {
 			id, _, err := c.AddGroup(r.Group)
 			r.Id = id
 			return err
 		})
 	}
 
+	recordContainer("group", r.Id, r.Id, r.Exists, err)
+	if err != nil {
+		for _, x := range r.Children {
+			x.skip()
+		}
+		return
+	}
+
 	for _, x := range r.Children {
 		x.inflate(r.Id)
 	}
 }
 
-func (r *scanGroup) discover(folder string, path []string) {
-	groups++
-	scan(folder, func(name string, mode os.FileMode) {
-		if mode.IsDir() {
-			newPath := append(path, name)
+func (r *scanGroup) skip() {
+	recordSkipped("group", r.Id)
+	for _, x := range r.Children {
+		x.skip()
+	}
+}
 
-			project := &scanProject{
-				Project: &api.Project{
-					Name: name,
-				},
-			}
+func (r *scanGroup) project(label string) *scanProject {
+	for _, x := range r.Children {
+		if x.Name == label {
+			return x
+		}
+	}
 
-			c := resolveLast(newPath)
-			if c != nil {
-				project.Exists = true
-				project.Id = c.GetId()
-			}
+	projects++
+	project := &scanProject{
+		Project: &api.Project{
+			Name: label,
+		},
+		path: extendPath(r.path, label),
+	}
 
-			project.discover(filepath.Join(folder, name), newPath)
+	c := resolveLast(project.path)
+	if c != nil {
+		project.Exists = true
+		project.Id = c.GetId()
+	}
 
-			r.Children = append(r.Children, project)
-		} else {
-			fmt.Fprintln(&reportBottom, "File", name, "ignored as attachments to groups are not allowed")
-		}
-	})
+	r.Children = append(r.Children, project)
+	return project
 }
 
 type scanProject struct {
@@ -183,6 +434,8 @@ type scanProject struct {
 	Exists      bool
 	Children    []*scanSubject
 	Attachments []*api.UploadSource
+
+	path []string
 }
 
 func (r *scanProject) report(i string) {
@@ -199,28 +452,26 @@ func (r *scanProject) report(i string) {
 
 func (r *scanProject) inflate(groupId string) {
 	r.GroupId = groupId
+	var err error
 
 	if !r.Exists {
 		Println("Creating project", r.Name)
 
-		retry(func() error {
+		err = retry(func() error {
 			id, _, err := c.AddProject(r.Project)
 			r.Id = id
 			return err
 		})
 	}
 
-	for _, x := range r.Attachments {
-		Println("Upload file", x.Name)
-		retry(func() error {
-			progress, result := c.UploadSimple("projects/"+r.Id+"/files", nil, x)
-
-			for update := range progress {
-				Println("  Uploaded", humanize.Bytes(uint64(update)))
-			}
+	recordContainer("project", r.Name, r.Id, r.Exists, err)
+	if err != nil {
+		r.skipContents()
+		return
+	}
 
-			return <-result
-		})
+	for _, x := range r.Attachments {
+		uploadFile("projects/"+r.Id, x)
 	}
 
 	for _, x := range r.Children {
@@ -228,36 +479,72 @@ func (r *scanProject) inflate(groupId string) {
 	}
 }
 
-func (r *scanProject) discover(folder string, path []string) {
-	projects++
-	scan(folder, func(name string, mode os.FileMode) {
-		if mode.IsDir() {
+func (r *scanProject) skip() {
+	recordSkipped("project", r.Name)
+	r.skipContents()
+}
 
-			subject := &scanSubject{
-				Subject: &api.Subject{
-					// Id:   randStringOfLength(24),
-					Code: name,
-				},
-			}
+func (r *scanProject) skipContents() {
+	for _, x := range r.Attachments {
+		skipFile(x.Name, x.Path, "project "+r.Name+" was not created")
+	}
+	for _, x := range r.Children {
+		x.skip()
+	}
+}
+
+func (r *scanProject) subject(code string) *scanSubject {
+	for _, x := range r.Children {
+		if x.Code == code {
+			return x
+		}
+	}
 
-			// does NOT append to path because subjects are not in resolver
-			subject.discover(filepath.Join(folder, name), path)
+	subjects++
+	subject := &scanSubject{
+		Subject: &api.Subject{
+			Code: code,
+		},
+		// Older resolvers list sessions directly under the project
+		path: r.path,
+	}
 
-			r.Children = append(r.Children, subject)
-		} else {
-			attachment := api.CreateUploadSourceFromFilenames(filepath.Join(folder, name))[0]
-			r.Attachments = append(r.Attachments, attachment)
+	// Fetched once; subjects and their sessions are matched against this listing
+	for _, x := range resolveChildren(r.path) {
+		switch child := x.(type) {
+		case *legacy.Subject:
+			if child.Code == code {
+				subject.Exists = true
+				subject.Id = child.Id
+				subject.path = extendPath(r.path, fmt.Sprintf("<id:%s>", child.Id))
+			}
+		case *legacy.Session:
+			if !subject.Exists && child.Subject != nil && child.Subject.Code == code && child.Subject.Id != "" {
+				subject.Exists = true
+				subject.Id = child.Subject.Id
+			}
 		}
-	})
+	}
+
+	r.Children = append(r.Children, subject)
+	return subject
 }
 
 type scanSubject struct {
 	*api.Subject
-	Children []*scanSession
+	Exists      bool
+	Children    []*scanSession
+	Attachments []*api.UploadSource
+
+	path []string
 }
 
 func (r *scanSubject) report(i string) {
-	Println(i + supplicant + spacer + r.Code)
+	Println(i + supplicant + spacer + r.Code + rE(r.Exists))
+
+	for _, x := range r.Attachments {
+		Println(i + increment + supplicant + spacer + x.Name)
+	}
 
 	for _, x := range r.Children {
 		x.report(i + increment)
@@ -265,44 +552,80 @@ func (r *scanSubject) report(i string) {
 }
 
 func (r *scanSubject) inflate(groupId, projectId string) {
+	var err error
+
+	if !r.Exists {
+		Println("Creating subject", r.Code)
+
+		err = retry(func() error {
+			id, err := addSubject(r.Subject, projectId)
+			r.Id = id
+			return err
+		})
+	}
+
+	recordContainer("subject", r.Code, r.Id, r.Exists, err)
+	if err != nil {
+		r.skipContents()
+		return
+	}
+
+	for _, x := range r.Attachments {
+		uploadFile("subjects/"+r.Id, x)
+	}
+
 	for _, x := range r.Children {
 		x.inflate(groupId, projectId)
 	}
 }
 
-func (r *scanSubject) discover(folder string, path []string) {
-	subjects++
-	scan(folder, func(name string, mode os.FileMode) {
-		if mode.IsDir() {
-			newPath := append(path, name)
+func (r *scanSubject) skip() {
+	recordSkipped("subject", r.Code)
+	r.skipContents()
+}
 
-			session := &scanSession{
-				Session: &api.Session{
-					Name:    name,
-					Subject: r.Subject,
-				},
-			}
-			resolveResult, _, _, _ := legacy.ResolvePath(c, path)
-			if resolveResult != nil {
-				for j := 0; j < len(resolveResult.Children); j++ {
-					child, ok := resolveResult.Children[j].(*legacy.Session)
-					if ok && child.GetSubjectCode() == r.Subject.Code && child.GetName() == session.Name {
-						s := fmt.Sprintf("<id:%s>", child.GetId())
-						newPath = append(path, s)
-						session.Exists = true
-						session.Id = child.GetId()
-						break
-					}
-				}
-			}
+func (r *scanSubject) skipContents() {
+	for _, x := range r.Attachments {
+		skipFile(x.Name, x.Path, "subject "+r.Code+" was not created")
+	}
+	for _, x := range r.Children {
+		x.skip()
+	}
+}
 
-			session.discover(filepath.Join(folder, name), newPath)
+func (r *scanSubject) session(label string) *scanSession {
+	for _, x := range r.Children {
+		if x.Name == label {
+			return x
+		}
+	}
 
-			r.Children = append(r.Children, session)
-		} else {
-			fmt.Fprintln(&reportBottom, "File", name, "ignored as attachments to subjects are not allowed")
+	sessions++
+	session := &scanSession{
+		Session: &api.Session{
+			Name:    label,
+			Subject: r.Subject,
+		},
+		path: extendPath(r.path, label),
+	}
+
+	if r.Exists {
+		// Either the subject's own listing, or the project's when subjects are not in resolver
+		for _, x := range resolveChildren(r.path) {
+			child, ok := x.(*legacy.Session)
+
+			// Sessions listed under a subject may omit the subject reference
+			if ok && (child.Subject == nil || child.GetSubjectCode() == r.Subject.Code) && child.GetName() == label {
+				session.path = extendPath(r.path, fmt.Sprintf("<id:%s>", child.GetId()))
+				session.Exists = true
+				session.Id = child.GetId()
+				break
+			}
 		}
-	})
+	}
+
+	r.Children = append(r.Children, session)
+	return session
 }
 
 type scanSession struct {
@@ -310,6 +633,8 @@ type scanSession struct {
 	Exists      bool
 	Children    []*scanAcquisition
 	Attachments []*api.UploadSource
+
+	path []string
 }
 
 func (r *scanSession) report(i string) {
@@ -328,27 +653,26 @@ func (r *scanSession) inflate(groupId, projectId string) {
 	// r.GroupId = groupId
 	r.ProjectId = projectId
 
+	var err error
+
 	if !r.Exists {
 		Println("Creating session", r.Name)
 
-		retry(func() error {
+		err = retry(func() error {
 			id, _, err := c.AddSession(r.Session)
 			r.Id = id
 			return err
 		})
 	}
 
-	for _, x := range r.Attachments {
-		Println("Upload file", x.Name)
-		retry(func() error {
-			progress, result := c.UploadSimple("sessions/"+r.Id+"/files", nil, x)
-
-			for update := range progress {
-				Println("  Uploaded", humanize.Bytes(uint64(update)))
-			}
+	recordContainer("session", r.Name, r.Id, r.Exists, err)
+	if err != nil {
+		r.skipContents()
+		return
+	}
 
-			return <-result
-		})
+	for _, x := range r.Attachments {
+		uploadFile("sessions/"+r.Id, x)
 	}
 
 	for _, x := range r.Children {
@@ -373,32 +697,42 @@ func (r *scanSession) inflate(groupId, projectId string) {
 	}
 }
 
-func (r *scanSession) discover(folder string, path []string) {
-	sessions++
-	scan(folder, func(name string, mode os.FileMode) {
-		if mode.IsDir() {
-			newPath := append(path, name)
+func (r *scanSession) skip() {
+	recordSkipped("session", r.Name)
+	r.skipContents()
+}
 
-			acquisition := &scanAcquisition{
-				Acquisition: &api.Acquisition{
-					Name: name,
-				},
-			}
+func (r *scanSession) skipContents() {
+	for _, x := range r.Attachments {
+		skipFile(x.Name, x.Path, "session "+r.Name+" was not created")
+	}
+	for _, x := range r.Children {
+		x.skip()
+	}
+}
 
-			c := resolveLast(newPath)
-			if c != nil {
-				acquisition.Exists = true
-				acquisition.Id = c.GetId()
-			}
+func (r *scanSession) acquisition(label string) *scanAcquisition {
+	for _, x := range r.Children {
+		if x.Name == label {
+			return x
+		}
+	}
 
-			acquisition.discover(filepath.Join(folder, name), newPath)
+	acquisitions++
+	acquisition := &scanAcquisition{
+		Acquisition: &api.Acquisition{
+			Name: label,
+		},
+	}
 
-			r.Children = append(r.Children, acquisition)
-		} else {
-			attachment := api.CreateUploadSourceFromFilenames(filepath.Join(folder, name))[0]
-			r.Attachments = append(r.Attachments, attachment)
-		}
-	})
+	c := resolveLast(extendPath(r.path, label))
+	if c != nil {
+		acquisition.Exists = true
+		acquisition.Id = c.GetId()
+	}
+
+	r.Children = append(r.Children, acquisition)
+	return acquisition
 }
 
 type scanAcquisition struct {
@@ -416,127 +750,66 @@ func (r *scanAcquisition) report(i string) {
 	}
 
 	for _, x := range r.Packfiles {
-		Println(i + increment + supplicant + spacer + " (*) " + x.Name)
+		packType := packfileType(x.Name)
+		if packType == x.Name {
+			Println(i + increment + supplicant + spacer + " (*) " + x.Name)
+		} else {
+			Println(i + increment + supplicant + spacer + " (*) " + x.Name + " as " + packType)
+		}
 	}
 }
 
 func (r *scanAcquisition) inflate(sessionId, projectId string, metadata map[string]interface{}) {
 	r.SessionId = sessionId
+	var err error
 
 	if !r.Exists {
 		Println("Creating acquisition", r.Name)
 
-		retry(func() error {
+		err = retry(func() error {
 			id, _, err := c.AddAcquisition(r.Acquisition)
 			r.Id = id
 			return err
 		})
 	}
 
-	for _, x := range r.Attachments {
-		Println("Upload file", x.Name)
-		retry(func() error {
-			progress, result := c.UploadSimple("acquisitions/"+r.Id+"/files", nil, x)
-
-			for update := range progress {
-				Println("  Uploaded", humanize.Bytes(uint64(update)))
-			}
+	recordContainer("acquisition", r.Name, r.Id, r.Exists, err)
+	if err != nil {
+		r.skipContents()
+		return
+	}
 
-			return <-result
-		})
+	for _, x := range r.Attachments {
+		uploadFile("acquisitions/"+r.Id, x)
 	}
 
 	for _, x := range r.Packfiles {
 		name := filepath.Base(x.Path)
-		Println("Upload packfile", name)
-
-		retry(func() error {
-
-			metadata["packfile"] = map[string]interface{}{
-				"type": name,
-			}
-
-			mdRaw, err := json.Marshal(&metadata)
-			if err != nil {
-				return err
-			}
-			mdString := string(mdRaw)
-
-			var aerr *api.Error
-
-			type tokenResponse struct {
-				Token string `json:"token"`
-			}
-
-			var response *tokenResponse
-
-			_, err = c.New().Post("projects/"+projectId+"/packfile-start").Receive(&response, &aerr)
-
-			if err != nil {
-				return err
-			} else if aerr != nil {
-				return errors.New(aerr.Message)
-			} else if response == nil || response.Token == "" {
-				return errors.New("Packfile token was empty or missing")
-			}
-
-			token := response.Token
-
-			Println("Scanning", x.Path)
-			var paths []*api.UploadSource
-			scan(x.Path, func(name string, mode os.FileMode) {
-				if mode.IsRegular() {
-					src := api.CreateUploadSourceFromFilenames(filepath.Join(x.Path, name))[0]
-					paths = append(paths, src)
-				}
-			})
-
-			progress, result := c.UploadSimple("projects/"+projectId+"/packfile?token="+token, nil, paths...)
-
-			for update := range progress {
-				Println("  Uploaded", humanize.Bytes(uint64(update)))
-			}
-
-			err = <-result
-			if err != nil {
-				return err
-			}
-
-			/*
-				metadata:{"project":{"_id":"58a47373d2b6ed0013a4a9fb"},"session":{"label":"01/01/70 00:00 AM","subject":{"code":"XXX"}},"acquisition":{"label":"Localizer","timestamp":"1970-01-01T06:00:00.000Z"},"packfile":{"type":"dicom"}}
-			*/
-			packfileQuery := &PackfileQuery{
-				Token:    token,
-				Metadata: mdString,
-			}
-
-			req, err := c.New().Get("projects/" + projectId + "/packfile-end").QueryStruct(packfileQuery).Request()
+		packType := packfileType(name)
 
-			if err != nil {
-				return err
-			}
+		if packMode == PackZip {
+			r.uploadZip(x, name, packType)
+		} else {
+			r.uploadPackfile(x, name, packType, projectId, metadata)
+		}
+	}
+}
 
-			// Start SSE
-			resp, err := c.Doer.Do(req)
-			if err != nil {
-				return err
-			}
+func (r *scanAcquisition) skip() {
+	recordSkipped("acquisition", r.Name)
+	r.skipContents()
+}
 
-			// Wait for SSE
-			if resp.StatusCode == 200 {
-				_, err = io.Copy(ioutil.Discard, resp.Body)
-				return err
-			} else {
-				// Needs robust handling for body & raw nils
-				raw, _ := ioutil.ReadAll(resp.Body)
-				return errors.New(string(raw))
-			}
-		})
+func (r *scanAcquisition) skipContents() {
+	for _, x := range r.Attachments {
+		skipFile(x.Name, x.Path, "acquisition "+r.Name+" was not created")
+	}
+	for _, x := range r.Packfiles {
+		skipFile(filepath.Base(x.Path), x.Path, "acquisition "+r.Name+" was not created")
 	}
 }
 
-func (r *scanAcquisition) discover(folder string, path []string) {
-	acquisitions++
+func (r *scanAcquisition) discover(folder string) {
 	scan(folder, func(name string, mode os.FileMode) {
 		if mode.IsDir() {
 			packfiles++
@@ -557,6 +830,10 @@ var c *api.Client
 
 var reportBottom bytes.Buffer
 
+var importReport *ImportReport
+
+var resolveCache = map[string][]interface{}{}
+
 var groups = 0
 var projects = 0
 var subjects = 0
@@ -565,12 +842,41 @@ var acquisitions = 0
 var attachments = 0
 var packfiles = 0
 
-func ScanUpload(client *api.Client, folder string) {
+// ScanOptions configures how ScanUpload maps a folder onto the hierarchy and uploads it.
+type ScanOptions struct {
+	// Folder layout, see DefaultScanTemplate
+	Template string
+
+	// Fixed labels for hierarchy levels, keyed by level name
+	Overrides map[string]string
+
+	// Optional path to write a JSON import report to
+	ReportPath string
+
+	// How folders under an acquisition are uploaded: PackPackfile or PackZip
+	Pack string
+
+	// Packfile types, either TYPE for every folder or FOLDER=TYPE for one
+	PackfileTypes []string
+
+	// Upload without confirming, and retry failed requests without asking
+	Yes bool
+}
+
+func ScanUpload(client *api.Client, folder string, options *ScanOptions) {
 	c = client
+	importReport = NewImportReport()
+	reportPath := options.ReportPath
+	unattended = options.Yes || !isatty.IsTerminal(os.Stdin.Fd())
+
+	t, err := parseScanTemplate(options.Template, options.Overrides)
+	Check(err)
+
+	Check(setPackOptions(options.Pack, options.PackfileTypes))
 
 	root := &scanRoot{}
 
-	root.discover(folder)
+	root.discover(folder, t)
 
 	Println()
 	Println("The following data hierarchy was found:")
@@ -586,15 +892,33 @@ func ScanUpload(client *api.Client, folder string) {
 		whatever, sessions, "sessions,\n",
 		whatever, acquisitions, "acquisitions,\n",
 		whatever, attachments, "attachments, and\n",
-		whatever, packfiles, "packfiles.\n")
-	proceed := prompt.Confirm("Confirm upload? (yes/no)")
+		whatever, packfiles, "packfiles.")
 	Println()
-	if !proceed {
-		Println("Canceled.")
-		return
+	if !options.Yes {
+		proceed := prompt.Confirm("Confirm upload? (yes/no)")
+		Println()
+		if !proceed {
+			Println("Canceled.")
+			return
+		}
 	}
 	Println("Beginning upload.")
 	Println()
 
 	root.inflate()
+
+	if reportPath != "" {
+		Check(importReport.Save(reportPath))
+		Println("Wrote import report to", reportPath)
+	}
+
+	exitCode := importReport.ExitCode()
+	if exitCode != ExitSuccess {
+		Println()
+		Println("Import finished with", len(importReport.Errors), "errors:")
+		for _, x := range importReport.Errors {
+			Println("  " + x)
+		}
+		Fatal(exitCode)
+	}
 }
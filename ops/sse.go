@@ -0,0 +1,90 @@
+package ops
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// sseEvent is a single server-sent event.
+// Ref: https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+type sseEvent struct {
+	Id    string
+	Event string
+	Data  string
+}
+
+// readEvents parses a text/event-stream, calling fn for each complete event until the stream ends or fn returns an error.
+// A stream that ends partway through an event, without the blank line that completes it, has been cut off; the
+// partial event is discarded and an error returned.
+func readEvents(r io.Reader, fn func(*sseEvent) error) error {
+	scanner := bufio.NewScanner(r)
+
+	// Result payloads can be larger than the default token size
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	event := &sseEvent{}
+	var data []string
+	pending := false
+
+	dispatch := func() error {
+		pending = false
+		if len(data) == 0 {
+			event = &sseEvent{}
+			return nil
+		}
+
+		event.Data = strings.Join(data, "\n")
+		if event.Event == "" {
+			event.Event = "message"
+		}
+
+		err := fn(event)
+		event = &sseEvent{}
+		data = nil
+		return err
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		if line == "" {
+			err := dispatch()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Comments are used as keep-alives
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		pending = true
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			event.Id = value
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return err
+	}
+
+	if pending {
+		return errors.New("Event stream ended in the middle of an event")
+	}
+	return nil
+}
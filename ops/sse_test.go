@@ -0,0 +1,207 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func collectEvents(t *testing.T, stream string) []sseEvent {
+	var events []sseEvent
+	err := readEvents(strings.NewReader(stream), func(event *sseEvent) error {
+		events = append(events, *event)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestReadEvents(t *testing.T) {
+	cases := []struct {
+		name   string
+		stream string
+		want   []sseEvent
+	}{
+		{
+			name:   "multi-line data",
+			stream: "event: result\ndata: {\"a\":\ndata: 1}\n\n",
+			want:   []sseEvent{{Event: "result", Data: "{\"a\":\n1}"}},
+		},
+		{
+			name:   "comments and keep-alives",
+			stream: ": keep-alive\n\n:\nevent: progress\n: ignored\ndata: x\n\n: keep-alive\n\n",
+			want:   []sseEvent{{Event: "progress", Data: "x"}},
+		},
+		{
+			name:   "CRLF line endings",
+			stream: "id: 7\r\nevent: progress\r\ndata: x\r\n\r\ndata: y\r\n\r\n",
+			want:   []sseEvent{{Id: "7", Event: "progress", Data: "x"}, {Event: "message", Data: "y"}},
+		},
+		{
+			name:   "field without a value or space",
+			stream: "event:error\ndata\ndata:x\n\n",
+			want:   []sseEvent{{Event: "error", Data: "\nx"}},
+		},
+		{
+			name:   "no data",
+			stream: "event: progress\n\n",
+			want:   nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := collectEvents(t, c.stream)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestReadEventsStopsOnError(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	err := readEvents(strings.NewReader("data: 1\n\ndata: 2\n\n"), func(event *sseEvent) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("got %v after %d calls, want %v after 1", err, calls, stop)
+	}
+}
+
+func TestReadEventsDiscardsUnfinishedEvent(t *testing.T) {
+	var events []sseEvent
+	err := readEvents(strings.NewReader("event: progress\ndata: 1\n\nevent: result\ndata: 2"), func(event *sseEvent) error {
+		events = append(events, *event)
+		return nil
+	})
+	if err == nil {
+		t.Error("a stream cut off mid-event was read without an error")
+	}
+	if want := []sseEvent{{Event: "progress", Data: "1"}}; !reflect.DeepEqual(events, want) {
+		t.Errorf("got %+v, want %+v", events, want)
+	}
+}
+
+func TestReadPackfileEvents(t *testing.T) {
+	cases := []struct {
+		name   string
+		stream string
+		want   *packfileResult
+		err    string
+	}{
+		{
+			name:   "result",
+			stream: "event: progress\ndata: {\"done\":1,\"total\":2,\"percent\":50}\n\nevent: result\ndata: {\"acquisition_id\":\"a\",\"session_id\":\"s\"}\n\n",
+			want:   &packfileResult{AcquisitionId: "a", SessionId: "s"},
+		},
+		{
+			name:   "error event",
+			stream: "event: progress\ndata: {\"done\":1,\"total\":2,\"percent\":50}\n\nevent: error\ndata: {\"message\":\"disk full\"}\n\n",
+			err:    "Server failed to pack files: disk full",
+		},
+		{
+			name:   "error event with plain text",
+			stream: "event: error\ndata: disk full\n\n",
+			err:    "Server failed to pack files: disk full",
+		},
+		{
+			name:   "result without a trailing blank line",
+			stream: "event: result\ndata: {\"acquisition_id\":\"a\",\"session_id\":\"s\"}\n",
+			err:    "Event stream ended in the middle of an event",
+		},
+		{
+			name:   "ends without a result",
+			stream: "event: progress\ndata: {\"done\":1,\"total\":2,\"percent\":50}\n\n",
+			err:    "Packfile event stream ended without a result",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := readPackfileEvents(strings.NewReader(c.stream))
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result, c.want) {
+				t.Errorf("got %+v, want %+v", result, c.want)
+			}
+		})
+	}
+}
+
+// packfileEndServer stands in for the packfile-end endpoint, sending events and then cutting the connection
+// partway through the next one.
+func packfileEndServer(t *testing.T, events string, partial string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/packfile-end") {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, events)
+		w.(http.Flusher).Flush()
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Write the start of a chunk that never finishes, then drop the connection
+		fmt.Fprintf(buf, "%x\r\n%s", len(partial)+100, partial)
+		buf.Flush()
+		conn.Close()
+	}))
+}
+
+func TestPackfileEndEndsMidStream(t *testing.T) {
+	server := packfileEndServer(t,
+		"event: progress\ndata: {\"done\":1,\"total\":2,\"percent\":50}\n\n",
+		"event: result\ndata: {\"acquisition_id\":")
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/projects/p/packfile-end?token=t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	result, err := readPackfileEvents(resp.Body)
+	if err == nil {
+		t.Fatalf("got result %+v from a stream that ended mid-event", result)
+	}
+}
+
+func TestPackfileEndClosesWithoutResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep-alive\n\nevent: progress\ndata: {\"done\":2,\"total\":2,\"percent\":100}\n\n")
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/projects/p/packfile-end?token=t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	_, err = readPackfileEvents(resp.Body)
+	if err == nil || err.Error() != "Packfile event stream ended without a result" {
+		t.Fatalf("got error %v", err)
+	}
+}
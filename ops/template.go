@@ -0,0 +1,187 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultScanTemplate is the folder layout that import folder expects when no template is given.
+const DefaultScanTemplate = "{group}/{project}/{subject}/{session}/{acquisition}"
+
+// Hierarchy levels, in the order they must become known.
+var scanLevels = []string{"group", "project", "subject", "session", "acquisition"}
+
+// scanTemplate maps folder names, one path segment at a time, onto hierarchy labels.
+type scanTemplate struct {
+	segments  []*regexp.Regexp
+	overrides map[string]string
+}
+
+// parseScanTemplate compiles a template such as "{subject}_{session}/{acquisition}/*".
+//
+// Each path segment is matched against one folder level. A placeholder {level} captures a label,
+// {level:regex} captures a label with a custom pattern, and * matches anything. Overrides fix a
+// level to a given label regardless of what the template captures.
+func parseScanTemplate(template string, overrides map[string]string) (*scanTemplate, error) {
+	t := &scanTemplate{overrides: map[string]string{}}
+
+	for level, label := range overrides {
+		if label == "" {
+			continue
+		}
+		if !isScanLevel(level) {
+			return nil, errors.New("Unknown hierarchy level " + level)
+		}
+		t.overrides[level] = label
+	}
+
+	segments := strings.Split(strings.Trim(template, "/"), "/")
+
+	// A trailing * only marks where files live
+	for len(segments) > 0 && segments[len(segments)-1] == "*" {
+		segments = segments[:len(segments)-1]
+	}
+
+	if len(segments) == 0 {
+		return nil, errors.New("Template " + template + " does not contain any folder levels")
+	}
+
+	known := t.values()
+
+	for _, segment := range segments {
+		re, err := parseTemplateSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, level := range re.SubexpNames() {
+			if level != "" {
+				known[level] = ""
+			}
+		}
+
+		err = checkLevelOrder(known)
+		if err != nil {
+			return nil, err
+		}
+
+		t.segments = append(t.segments, re)
+	}
+
+	return t, nil
+}
+
+// parseTemplateSegment converts one path segment into an anchored regular expression.
+func parseTemplateSegment(segment string) (*regexp.Regexp, error) {
+	var pattern []byte
+	seen := map[string]bool{}
+
+	for i := 0; i < len(segment); i++ {
+		switch segment[i] {
+		case '{':
+			// Find the matching brace, allowing for quantifiers such as \d{3} inside a custom pattern
+			depth := 1
+			j := i + 1
+			for ; j < len(segment) && depth > 0; j++ {
+				if segment[j] == '{' {
+					depth++
+				} else if segment[j] == '}' {
+					depth--
+				}
+			}
+			if depth != 0 {
+				return nil, errors.New("Unclosed placeholder in template segment " + segment)
+			}
+
+			level := segment[i+1 : j-1]
+			expr := ".+?"
+			if k := strings.Index(level, ":"); k >= 0 {
+				level, expr = level[:k], level[k+1:]
+			}
+
+			if !isScanLevel(level) {
+				return nil, errors.New("Unknown hierarchy level {" + level + "} in template segment " + segment)
+			}
+			if seen[level] {
+				return nil, errors.New("Level {" + level + "} appears twice in template segment " + segment)
+			}
+			seen[level] = true
+
+			pattern = append(pattern, fmt.Sprintf("(?P<%s>%s)", level, expr)...)
+			i = j - 1
+
+		case '*':
+			pattern = append(pattern, ".*"...)
+
+		default:
+			pattern = append(pattern, regexp.QuoteMeta(segment[i:i+1])...)
+		}
+	}
+
+	re, err := regexp.Compile("^" + string(pattern) + "$")
+	if err != nil {
+		return nil, errors.New("Invalid pattern in template segment " + segment + ": " + err.Error())
+	}
+	return re, nil
+}
+
+// checkLevelOrder ensures a level is only known once every level above it is.
+func checkLevelOrder(known map[string]string) error {
+	for i, level := range scanLevels {
+		if _, ok := known[level]; !ok {
+			continue
+		}
+		for _, parent := range scanLevels[:i] {
+			if _, ok := known[parent]; !ok {
+				return errors.New("Template resolves {" + level + "} before {" + parent + "}; add {" + parent + "} to the template or set it with --" + parent)
+			}
+		}
+	}
+	return nil
+}
+
+func isScanLevel(level string) bool {
+	for _, x := range scanLevels {
+		if x == level {
+			return true
+		}
+	}
+	return false
+}
+
+// values returns a fresh copy of the overridden levels, the starting point of every walk.
+func (t *scanTemplate) values() map[string]string {
+	result := map[string]string{}
+	for level, label := range t.overrides {
+		result[level] = label
+	}
+	return result
+}
+
+// match tests a folder name against the segment at depth, returning values extended with its captures.
+func (t *scanTemplate) match(depth int, name string, values map[string]string) (map[string]string, bool) {
+	re := t.segments[depth]
+	matches := re.FindStringSubmatch(name)
+	if matches == nil {
+		return nil, false
+	}
+
+	result := map[string]string{}
+	for level, label := range values {
+		result[level] = label
+	}
+
+	for i, level := range re.SubexpNames() {
+		if level == "" {
+			continue
+		}
+		if _, fixed := t.overrides[level]; fixed {
+			continue
+		}
+		result[level] = matches[i]
+	}
+
+	return result, true
+}
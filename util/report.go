@@ -0,0 +1,135 @@
+package util
+
+import (
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// Container outcomes recorded in an ImportReport.
+const (
+	ContainerCreated = "created"
+	ContainerUsed    = "used"
+	ContainerFailed  = "failed"
+	ContainerSkipped = "skipped"
+
+	// Found or created server-side by UID during a DICOM upload
+	ContainerByUid = "uid"
+)
+
+// File outcomes recorded in an ImportReport.
+const (
+	FileUploaded = "uploaded"
+	FileSkipped  = "skipped"
+	FileFailed   = "failed"
+)
+
+// Exit codes for imports: distinguish a clean run from one where only some uploads went through.
+const (
+	ExitSuccess        = 0
+	ExitTotalFailure   = 1
+	ExitPartialFailure = 2
+)
+
+type ReportContainer struct {
+	Type   string `json:"type"`
+	Label  string `json:"label"`
+	Id     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReportFile struct {
+	Name      string  `json:"name"`
+	Path      string  `json:"path,omitempty"`
+	Container string  `json:"container,omitempty"`
+	Status    string  `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration_seconds"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ImportReport is a machine-readable record of everything an import did. Safe for concurrent use.
+type ImportReport struct {
+	Started    time.Time          `json:"started"`
+	Finished   time.Time          `json:"finished"`
+	Containers []*ReportContainer `json:"containers"`
+	Files      []*ReportFile      `json:"files"`
+	Errors     []string           `json:"errors"`
+
+	mutex sync.Mutex
+}
+
+func NewImportReport() *ImportReport {
+	return &ImportReport{
+		Started:    time.Now(),
+		Containers: []*ReportContainer{},
+		Files:      []*ReportFile{},
+		Errors:     []string{},
+	}
+}
+
+func (r *ImportReport) AddContainer(x *ReportContainer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Containers = append(r.Containers, x)
+	if x.Error != "" {
+		r.Errors = append(r.Errors, x.Type+" "+x.Label+": "+x.Error)
+	}
+}
+
+func (r *ImportReport) AddFile(x *ReportFile) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Files = append(r.Files, x)
+	if x.Status == FileFailed && x.Error != "" {
+		r.Errors = append(r.Errors, x.Name+": "+x.Error)
+	}
+}
+
+func (r *ImportReport) AddError(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// ExitCode reports total failure when nothing was uploaded despite failures, and partial failure when only some of it was.
+func (r *ImportReport) ExitCode() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	uploaded, failed := 0, 0
+	for _, x := range r.Files {
+		switch x.Status {
+		case FileUploaded:
+			uploaded++
+		case FileFailed:
+			failed++
+		}
+	}
+	for _, x := range r.Containers {
+		if x.Status == ContainerFailed {
+			failed++
+		}
+	}
+
+	if failed == 0 && len(r.Errors) == 0 {
+		return ExitSuccess
+	} else if uploaded == 0 {
+		return ExitTotalFailure
+	} else {
+		return ExitPartialFailure
+	}
+}
+
+// Save writes the report as JSON to path.
+func (r *ImportReport) Save(path string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Finished = time.Now()
+	return ioutil.WriteFile(path, FormatBytes(r), 0644)
+}